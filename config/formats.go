@@ -0,0 +1,77 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * Support of the yaml and toml configuration formats. Both are converted to json, so every format is decoded by the
+ * same json decoder, into the same structs, with the same field names.
+ */
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_YAML = "yaml"
+	FORMAT_TOML = "toml"
+)
+
+// configFormat returns the format of the configuration file. An explicitly set format wins over the file extension,
+// files with an unknown extension are assumed to be json. The path can be a url as well.
+func configFormat(path string, format string) (string, error) {
+	if format == "" {
+		if parsed, err := url.Parse(path); err == nil && parsed.Scheme != "" {
+			path = parsed.Path
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			return FORMAT_YAML, nil
+		case ".toml":
+			return FORMAT_TOML, nil
+		}
+		return FORMAT_JSON, nil
+	}
+	switch strings.ToLower(format) {
+	case FORMAT_JSON:
+		return FORMAT_JSON, nil
+	case FORMAT_YAML, "yml":
+		return FORMAT_YAML, nil
+	case FORMAT_TOML:
+		return FORMAT_TOML, nil
+	}
+	return "", fmt.Errorf("unsupported config format: %s", format)
+}
+
+// toJSON converts the content of a configuration file in the given format to json.
+func toJSON(content []byte, format string) ([]byte, error) {
+	var data interface{}
+	switch format {
+	case FORMAT_JSON:
+		return content, nil
+	case FORMAT_YAML:
+		err := yaml.Unmarshal(content, &data)
+		if err != nil {
+			return nil, err
+		}
+	case FORMAT_TOML:
+		var table map[string]interface{}
+		err := toml.Unmarshal(content, &table)
+		if err != nil {
+			return nil, err
+		}
+		data = table
+	default:
+		return nil, fmt.Errorf("unsupported config format: %s", format)
+	}
+	content, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("config cannot be represented in json: %w", err)
+	}
+	return content, nil
+}
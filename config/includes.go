@@ -0,0 +1,90 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/*
+ * Implementation of the config fragment files, so every team can own the file of its targets. The config file
+ * includes fragments through globs, the fragments hold a targets list only, in any of the config formats:
+ *   {"targets": [...]}
+ * The targets of the fragments are added to the ones of the config file, a target id must be unique across all files.
+ * The include directories of a local config file are watched, the fragments of a config fetched from a url are only
+ * read again when the config changes.
+ */
+
+type fragmentConfig struct {
+	Targets []TargetSubConfig `json:"targets"`
+}
+
+// IncludePatterns returns the include globs of the config, resolved against the directory of the config file.
+func (c *Config) IncludePatterns() []string {
+	return c.includePatterns
+}
+
+// loadIncludes adds the targets of the fragment files matching the include globs. Relative globs are resolved against
+// the directory of the config file at path, or the working directory when the config was fetched from a url.
+func (c *Config) loadIncludes(path string) error {
+	c.includePatterns = nil
+	for _, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) && !IsRemoteConfig(path) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		// Checks the syntax of the pattern, Glob silently ignores malformed patterns.
+		_, err := filepath.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid include pattern: %s, error: %w", pattern, err)
+		}
+		c.includePatterns = append(c.includePatterns, pattern)
+	}
+
+	origins := make(map[string]string)
+	for _, target := range c.Targets {
+		origins[target.Id] = path
+	}
+	var errs []error
+	for _, pattern := range c.includePatterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			// A glob matching the config file itself must not include it twice.
+			if match == filepath.Clean(path) {
+				continue
+			}
+			content, err := os.ReadFile(match)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			var fragment fragmentConfig
+			interpolatedPaths, err := decodeDocument(content, "", match, true, &fragment)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", match, err))
+				continue
+			}
+
+			offset := len(c.Targets)
+			for _, interpolatedPath := range interpolatedPaths {
+				// Only the targets of the fragment are kept, their indexes move past the targets already there.
+				if len(interpolatedPath) > 1 && interpolatedPath[0] == "targets" {
+					shifted := append(configPath{"targets", interpolatedPath[1].(int) + offset}, interpolatedPath[2:]...)
+					c.interpolatedPaths = append(c.interpolatedPaths, shifted)
+				}
+			}
+			for _, target := range fragment.Targets {
+				if origin, ok := origins[target.Id]; ok && target.Id != "" {
+					errs = append(errs, fmt.Errorf("duplicate target id: %s in %s and %s", target.Id, origin, match))
+					continue
+				}
+				origins[target.Id] = match
+				c.Targets = append(c.Targets, target)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
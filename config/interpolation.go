@@ -0,0 +1,274 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Interpolation of references in the string values of the configuration, so secrets do not have to be committed:
+ *   ${NAME}              the value of the environment variable, which must be set
+ *   ${NAME:-default}     the value of the environment variable, or the default when it is unset or empty
+ *   ${file:/path}        the content of the file, without its trailing newlines, e.g. a docker or kubernetes secret
+ * $${ is a literal ${. The values holding references are redacted when the configuration is printed.
+ * A value made of a single reference fills number and boolean fields too, e.g. "port": "${INFLUX_PORT}", the resolved
+ * value is then parsed as a json number or a boolean.
+ * The references of a configuration fetched from a url are only resolved when it is signed, see RemoteSource.
+ */
+
+var configReference = regexp.MustCompile(`\$?\$\{([^{}]*)\}`)
+
+// REDACTED replaces the interpolated values when the configuration is printed.
+const REDACTED = "[REDACTED]"
+
+// secretFields are always redacted when the configuration is printed, even when they are set literally.
+var secretFields = map[string]bool{"password": true, "token": true, "client_secret": true, "api_key": true, "dsn": true}
+
+// configPath locates a value in the configuration document, as a list of object keys and array indexes.
+type configPath []interface{}
+
+func (path configPath) String() string {
+	var builder strings.Builder
+	for _, element := range path {
+		switch typed := element.(type) {
+		case int:
+			fmt.Fprintf(&builder, "[%d]", typed)
+		default:
+			if builder.Len() > 0 {
+				builder.WriteByte('.')
+			}
+			fmt.Fprint(&builder, typed)
+		}
+	}
+	return builder.String()
+}
+
+// interpolate resolves the references in the string values of the json document, which is decoded into a value of
+// type target. It returns the resolved document and the paths of the values which held references. All unresolvable
+// references are reported.
+func interpolate(content []byte, target reflect.Type) ([]byte, []configPath, error) {
+	if !bytes.Contains(content, []byte("${")) {
+		return content, nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var document interface{}
+	err := decoder.Decode(&document)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var paths []configPath
+	var errs []error
+	var walk func(value interface{}, path configPath, t reflect.Type) interface{}
+	walk = func(value interface{}, path configPath, t reflect.Type) interface{} {
+		for t != nil && t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		switch typed := value.(type) {
+		case map[string]interface{}:
+			for key, child := range typed {
+				typed[key] = walk(child, append(path[:len(path):len(path)], key), fieldType(t, key))
+			}
+		case []interface{}:
+			var elem reflect.Type
+			if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+				elem = t.Elem()
+			}
+			for i, child := range typed {
+				typed[i] = walk(child, append(path[:len(path):len(path)], i), elem)
+			}
+		case string:
+			resolved, found, err := resolveReferences(typed)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", path, err))
+				return typed
+			}
+			if !found {
+				return resolved
+			}
+			paths = append(paths, path)
+			// Only a value made of a single reference can fill a number or a boolean field.
+			if configReference.FindString(typed) == typed && !strings.HasPrefix(typed, "$$") {
+				return convertScalar(resolved, t)
+			}
+			return resolved
+		}
+		return value
+	}
+	document = walk(document, configPath{}, target)
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+
+	content, err = json.Marshal(document)
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, paths, nil
+}
+
+// fieldType returns the type of the value found under key in a json object decoded into a value of type t, or nil when
+// it is not known.
+func fieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" && field.Anonymous {
+				embedded := field.Type
+				if embedded.Kind() == reflect.Pointer {
+					embedded = embedded.Elem()
+				}
+				if found := fieldType(embedded, key); found != nil {
+					return found
+				}
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			if strings.EqualFold(name, key) {
+				return field.Type
+			}
+		}
+	}
+	return nil
+}
+
+// convertScalar converts the value resolved from a single reference to a number or a boolean when the field expects
+// one. Values which do not parse are left as strings, their decoding reports the mismatch.
+func convertScalar(value string, t reflect.Type) interface{} {
+	if t == nil {
+		return value
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if _, err := strconv.ParseFloat(value, 64); err == nil && json.Valid([]byte(value)) {
+			return json.Number(value)
+		}
+	case reflect.Bool:
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	}
+	return value
+}
+
+// resolveReferences replaces the references in the value. It tells whether the value held any reference.
+func resolveReferences(value string) (string, bool, error) {
+	found := false
+	var errs []error
+	resolved := configReference.ReplaceAllStringFunc(value, func(reference string) string {
+		if strings.HasPrefix(reference, "$$") {
+			return reference[1:]
+		}
+		found = true
+		expression := reference[2 : len(reference)-1]
+		if path, ok := strings.CutPrefix(expression, "file:"); ok {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				errs = append(errs, err)
+				return ""
+			}
+			return strings.TrimRight(string(content), "\r\n")
+		}
+		name, defaultValue, hasDefault := strings.Cut(expression, ":-")
+		envValue, ok := os.LookupEnv(name)
+		if hasDefault && envValue == "" {
+			return defaultValue
+		}
+		if !ok {
+			errs = append(errs, fmt.Errorf("environment variable %s is not set", name))
+		}
+		return envValue
+	})
+	return resolved, found, errors.Join(errs...)
+}
+
+// String prints the configuration as json, with the values resolved from references and the secret fields redacted.
+func (c *Config) String() string {
+	content, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Sprintf("unprintable config: %s", err)
+	}
+	var document interface{}
+	err = json.Unmarshal(content, &document)
+	if err != nil {
+		return fmt.Sprintf("unprintable config: %s", err)
+	}
+	for _, path := range c.interpolatedPaths {
+		redact(document, path)
+	}
+	redactSecretFields(document)
+	content, err = json.Marshal(document)
+	if err != nil {
+		return fmt.Sprintf("unprintable config: %s", err)
+	}
+	return string(content)
+}
+
+// redact replaces the value at the path, if it exists.
+func redact(document interface{}, path configPath) {
+	if len(path) == 0 {
+		return
+	}
+	switch typed := document.(type) {
+	case map[string]interface{}:
+		key, ok := path[0].(string)
+		if _, exists := typed[key]; !ok || !exists {
+			return
+		}
+		if len(path) == 1 {
+			typed[key] = REDACTED
+			return
+		}
+		redact(typed[key], path[1:])
+	case []interface{}:
+		i, ok := path[0].(int)
+		if !ok || i >= len(typed) {
+			return
+		}
+		if len(path) == 1 {
+			typed[i] = REDACTED
+			return
+		}
+		redact(typed[i], path[1:])
+	}
+}
+
+// redactSecretFields replaces the values of the secret fields found anywhere in the document.
+func redactSecretFields(document interface{}) {
+	switch typed := document.(type) {
+	case map[string]interface{}:
+		for key, child := range typed {
+			if value, ok := child.(string); ok && value != "" && secretFields[key] {
+				typed[key] = REDACTED
+				continue
+			}
+			redactSecretFields(child)
+		}
+	case []interface{}:
+		for _, child := range typed {
+			redactSecretFields(child)
+		}
+	}
+}
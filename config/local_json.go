@@ -1,43 +1,263 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"inspector/mylogger"
 	"io/ioutil"
+	"reflect"
+	"time"
 )
 
+// DEFAULT_PROBER_INTERVAL is used for probers that have no interval set on themselves nor on their target.
+var DEFAULT_PROBER_INTERVAL = 10 * time.Second
+
 /*
- * Implementation of local configuration in the json format.
+ * Implementation of local configuration in the json format. The yaml and toml formats are converted to json.
  * This will be extended to other types of configs in the future, database based configuration being the first priority.
  */
 
+// SpoolSubConfig configures the on disk buffer holding the metrics a backend failed to write.
+type SpoolSubConfig struct {
+	// Directory holding the spooled metrics. It must not be shared with another backend.
+	Directory string `json:"directory"`
+	// Maximum size of the spool in bytes, the oldest metrics are dropped past it. Empty stanza uses 100MB.
+	MaxSizeBytes int64 `json:"max_size_bytes,omitempty"`
+	// Bounds of the exponential backoff between replay attempts. Empty stanzas use 10s and 5m.
+	InitialBackoff string `json:"initial_backoff,omitempty"`
+	MaxBackoff     string `json:"max_backoff,omitempty"`
+}
+
 type InfluxDBSubConfig struct {
 	DatabaseURL  string `json:"database_url"`
 	Port         int    `json:"port"`
 	DatabaseName string `json:"database_name"`
 	Protocol     string `json:"transport_protocol"`
+	// Spools the metrics to disk while the database is unreachable. Empty stanza keeps them in memory only.
+	Spool *SpoolSubConfig `json:"spool,omitempty"`
+}
+
+type InfluxDB2SubConfig struct {
+	DatabaseURL string `json:"database_url"`
+	Port        int    `json:"port"`
+	// Either http or https. Empty stanza uses https.
+	Protocol     string `json:"transport_protocol,omitempty"`
+	Organization string `json:"org"`
+	Bucket       string `json:"bucket"`
+	// API token, sent in the Authorization header.
+	Token string `json:"token"`
+	// Compress the written metrics with gzip.
+	Gzip bool `json:"gzip,omitempty"`
+	// Spools the metrics to disk while the database is unreachable. Empty stanza keeps them in memory only.
+	Spool *SpoolSubConfig `json:"spool,omitempty"`
 }
 
 type MySQLDBSubConfig struct {
 	DatabaseURL  string `json:"database_url"`
 	Port         int    `json:"port"`
 	DatabaseName string `json:"database_name"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	// Metrics older than the retention, e.g. "720h", are pruned. Empty stanza keeps the metrics forever.
+	Retention string `json:"retention,omitempty"`
+}
+
+type PrometheusSubConfig struct {
+	// Address the /metrics listener binds to. Empty stanza listens on all interfaces.
+	ListenAddress string `json:"listen_address,omitempty"`
+	Port          int    `json:"port"`
+	// HTTP path the metrics are served on. Empty stanza uses /metrics.
+	Path string `json:"path,omitempty"`
+	// Upper bounds (in milliseconds) of the latency histogram buckets. Empty stanza uses the default buckets.
+	HistogramBuckets []float64 `json:"histogram_buckets,omitempty"`
+	// Series not updated for this long, e.g. "1h", are dropped. It must exceed the longest prober interval, or the
+	// series disappear between the runs. Empty stanza uses 15m.
+	SeriesTTL string `json:"series_ttl,omitempty"`
+}
+
+type OTLPSubConfig struct {
+	CollectorURL string `json:"collector_url"`
+	Port         int    `json:"port"`
+	// Either grpc or http (http/protobuf). Empty stanza uses grpc.
+	Protocol string `json:"transport_protocol,omitempty"`
+	// URL path of the http protocol. Empty stanza uses /v1/metrics.
+	URLPath string `json:"url_path,omitempty"`
+	// Disables tls towards the collector.
+	Insecure bool `json:"insecure,omitempty"`
+	// Headers sent with every export, e.g. for authentication.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Compress the exported metrics with gzip.
+	Gzip bool `json:"gzip,omitempty"`
+}
+
+type StatsDSubConfig struct {
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	// Sends the tags in the DogStatsD format. Plain StatsD has no tags, the metric name is built from PathTemplate.
+	DogStatsD bool `json:"dogstatsd,omitempty"`
+	// Metric name template of plain StatsD, see GraphiteSubConfig. Empty stanza uses the Graphite default.
+	PathTemplate string `json:"path_template,omitempty"`
+	// Prepended to every metric name, e.g. "inspector".
+	Prefix string `json:"prefix,omitempty"`
+	// Maximum size of the udp packets. Empty stanza uses 1432 bytes.
+	MaxPacketSize int `json:"max_packet_size,omitempty"`
+}
+
+type GraphiteSubConfig struct {
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	// Template of the metric path, where {name} is the metric name and {<tag>} the value of the tag, e.g.
+	// "{region}.{target_id}.{prober_id}.{name}", which is also the default. Components of missing tags are left out,
+	// tags not in the template are appended as <tag>.<value> pairs, except failed_assertion and failed_stage.
+	PathTemplate string `json:"path_template,omitempty"`
+	// Prepended to every metric path, e.g. "inspector".
+	Prefix string `json:"prefix,omitempty"`
 }
 
 type MetricsDBSubConfig struct {
-	*InfluxDBSubConfig `json:"influxdb,omitempty"`
-	*MySQLDBSubConfig  `json:"mysqldb,omitempty"`
+	*InfluxDBSubConfig   `json:"influxdb,omitempty"`
+	*InfluxDB2SubConfig  `json:"influxdb2,omitempty"`
+	*MySQLDBSubConfig    `json:"mysqldb,omitempty"`
+	*PrometheusSubConfig `json:"prometheus,omitempty"`
+	*OTLPSubConfig       `json:"otlp,omitempty"`
+	*StatsDSubConfig     `json:"statsd,omitempty"`
+	*GraphiteSubConfig   `json:"graphite,omitempty"`
+}
+
+// JSONPathCheck asserts that the value found at Path in a json response body equals Value.
+type JSONPathCheck struct {
+	// Path in the $.field.list[0].field form.
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// StatusCode is an accepted status code of the http prober, either an exact code, a class or a range. Exact codes can
+// be given as json numbers as well as strings.
+type StatusCode string
+
+func (code *StatusCode) UnmarshalJSON(data []byte) error {
+	var number json.Number
+	err := json.Unmarshal(data, &number)
+	if err == nil {
+		*code = StatusCode(number)
+		return nil
+	}
+	var value string
+	err = json.Unmarshal(data, &value)
+	if err != nil {
+		return fmt.Errorf("status code must be a number or a string, got: %s", data)
+	}
+	*code = StatusCode(value)
+	return nil
+}
+
+// HTTPValidationsSubConfig holds the assertions run against the response of an http prober. Every stanza is optional.
+type HTTPValidationsSubConfig struct {
+	// Accepted status codes, given as exact codes (200 or "200"), classes ("2xx") or ranges ("200-299").
+	StatusCodes []StatusCode `json:"status_codes,omitempty"`
+	// Headers which must be present in the response, mapped to a regular expression their value must match.
+	// An empty regular expression only checks for the presence of the header.
+	RequiredHeaders map[string]string `json:"required_headers,omitempty"`
+	// Headers which must not be present in the response.
+	ForbiddenHeaders []string `json:"forbidden_headers,omitempty"`
+	// Substrings the body must, or must not, contain.
+	BodyContains    []string `json:"body_contains,omitempty"`
+	BodyNotContains []string `json:"body_not_contains,omitempty"`
+	// Regular expressions the body must, or must not, match.
+	BodyRegex    []string `json:"body_regex,omitempty"`
+	BodyNotRegex []string `json:"body_not_regex,omitempty"`
+	// Equality checks on values of a json body.
+	JSONPath []JSONPathCheck `json:"json_path,omitempty"`
+	// Maximum accepted body size in bytes. Zero means no limit.
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+}
+
+// HTTPAuthSubConfig holds the credentials the http prober authenticates with. Only the stanzas of the chosen type are used.
+type HTTPAuthSubConfig struct {
+	// One of: basic, bearer, api_key, oauth2.
+	Type string `json:"type"`
+	// Credentials of the basic auth.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Static token sent as an Authorization bearer token.
+	Token string `json:"token,omitempty"`
+	// API key, sent in the header_name header. Empty header_name uses X-API-Key.
+	APIKey     string `json:"api_key,omitempty"`
+	HeaderName string `json:"header_name,omitempty"`
+	// OAuth2 client credentials flow. The token fetched from token_url is cached until it expires.
+	TokenURL     string   `json:"token_url,omitempty"`
+	ClientID     string   `json:"client_id,omitempty"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// TLSSubConfig holds the tls client settings of a prober. Every stanza is optional, empty ones use the Go defaults.
+type TLSSubConfig struct {
+	// PEM bundle of the certificate authorities trusted on top of the system ones.
+	CAFile string `json:"ca_file,omitempty"`
+	// PEM client certificate and key, for mutual tls.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// Overrides the server name sent in SNI and used to verify the server certificate.
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+	// TLS versions, one of: "1.0", "1.1", "1.2", "1.3".
+	MinVersion string `json:"min_version,omitempty"`
+	MaxVersion string `json:"max_version,omitempty"`
+	// Names of the allowed cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Not applicable to tls 1.3.
+	CipherSuites []string `json:"cipher_suites,omitempty"`
 }
 
 type ProberContextSubConfig struct {
 	Url               string            `json:"url"`
 	Method            string            `json:"method"`
 	RequestParameters map[string]string `json:"parameters"`
+	// Arbitrary request headers.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Request body, given either inline, as a path to a file holding it, or as a json value. At most one can be set.
+	Body     string      `json:"body,omitempty"`
+	BodyFile string      `json:"body_file,omitempty"`
+	BodyJSON interface{} `json:"body_json,omitempty"`
+	// Content type of the request body. Defaults to application/json for body_json.
+	ContentType string `json:"content_type,omitempty"`
+	// Authentication of the http requests. Empty stanza sends anonymous requests.
+	Auth *HTTPAuthSubConfig `json:"auth,omitempty"`
+	// TLS client settings.
+	TLS *TLSSubConfig `json:"tls,omitempty"`
+	// Protocol used to upgrade a plain connection to tls before the handshake, one of: smtp, imap, postgres.
+	// Empty stanza starts the handshake right away.
+	StartTLS string `json:"starttls,omitempty"`
 	// Holds the list of cookies
 	Cookies map[string]string `json:"cookies"`
 	// Whether to follow http redirects from the server or not. Empty stanza uses the default 10 level redirect limit.
 	AllowRedirects bool   `json:"allow_redirects,omitempty"`
 	Timeout        string `json:"timeout,omitempty"`
+	// Assertions deciding whether an http probe succeeded. Empty stanza only checks for a 2xx or 3xx status code.
+	Validations *HTTPValidationsSubConfig `json:"validations,omitempty"`
+	// Remote endpoint in the host:port form, used by the probers which are not url based.
+	Address string `json:"address,omitempty"`
+	// Data sent to the remote endpoint right after connecting. Optional.
+	Payload string `json:"payload,omitempty"`
+	// Regular expression the response (or the banner, when no payload is sent) must match. Optional.
+	ExpectedResponse string `json:"expected_response,omitempty"`
+	// Transport used by the prober, e.g. "udp" or "tcp" for the dns prober.
+	TransportProtocol string `json:"transport_protocol,omitempty"`
+	// Name and record type (A, AAAA, CNAME, MX, TXT, SRV, NS, SOA) queried by the dns prober.
+	QueryName string `json:"query_name,omitempty"`
+	QueryType string `json:"query_type,omitempty"`
+	// Answers which must all be present in the dns response, in their presentation format. Optional.
+	ExpectedAnswers []string `json:"expected_answers,omitempty"`
+	// Expected dns response code, e.g. "NOERROR" or "NXDOMAIN". Empty stanza expects NOERROR.
+	ExpectedRcode string `json:"expected_rcode,omitempty"`
+	// Bounds (in seconds) the TTL of every dns answer must fall into. Zero means no bound.
+	MinTTL uint32 `json:"min_ttl,omitempty"`
+	MaxTTL uint32 `json:"max_ttl,omitempty"`
+	// Number of echo requests sent by the icmp prober per run. Empty stanza sends ICMP_DEFAULT_COUNT requests.
+	Count int `json:"count,omitempty"`
+	// Pause between two consecutive echo requests of the icmp prober. Empty stanza uses ICMP_DEFAULT_PACKET_INTERVAL.
+	PacketInterval string `json:"packet_interval,omitempty"`
 }
 
 // ProberSubConfig holds configuration of each prober.
@@ -46,6 +266,8 @@ type ProberSubConfig struct {
 	Id string `json:"id"`
 	// A specific type of prober. It's a misnomer, should be renamed to type.
 	Name string `json:"name"`
+	// How often the prober runs, e.g. "5s" or "5m". Empty stanza falls back to the target's default interval.
+	Interval string `json:"interval,omitempty"`
 	// Prober configuration, dependent on the type of the prover above.
 	Context ProberContextSubConfig `json:"context"`
 }
@@ -56,6 +278,8 @@ type TargetSubConfig struct {
 	Id string `json:"id"`
 	// Freeform name of the current target.
 	Name string `json:"name"`
+	// Interval used by the probers of this target which do not set their own. Empty stanza uses DEFAULT_PROBER_INTERVAL.
+	DefaultInterval string `json:"default_interval,omitempty"`
 	// List of probers that live under this target.
 	Probers []ProberSubConfig `json:"probers"`
 }
@@ -66,24 +290,177 @@ type InspectorSubConfig struct {
 	Region string `json:"region"`
 }
 
+// ProbeInterval returns how often the prober should run. The prober's own interval wins over the target's default.
+func (p ProberSubConfig) ProbeInterval(target TargetSubConfig) (time.Duration, error) {
+	interval := p.Interval
+	if interval == "" {
+		interval = target.DefaultInterval
+	}
+	if interval == "" {
+		return DEFAULT_PROBER_INTERVAL, nil
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("prober interval must be positive, got: %s", interval)
+	}
+	return d, nil
+}
+
 type Config struct {
 	Inspector    InspectorSubConfig   `json:"inspector"`
 	TimeSeriesDB []MetricsDBSubConfig `json:"metrics_db"`
 	Targets      []TargetSubConfig    `json:"targets"`
+	// Globs of fragment files holding more targets, e.g. "targets.d/*.json". Relative globs are relative to the
+	// directory of the config file.
+	Include []string `json:"include,omitempty"`
+	// Database holding more targets. Empty stanza only uses the targets of the config file.
+	TargetsDB *TargetsDBSubConfig `json:"targets_db,omitempty"`
+	// Paths of the values resolved from references, they are redacted when the config is printed.
+	interpolatedPaths []configPath
+	// Include globs, resolved against the directory of the config file.
+	includePatterns []string
 }
 
-// NewConfig creates a new configuration. It currently assumes only json configuration.
-// TODO: extend NewConfig to support other types of config.
-func NewConfig(path string) (*Config, error) {
+// NewConfig creates a new configuration from a json, yaml or toml file. The format is detected from the file extension
+// unless it is set explicitly.
+func NewConfig(path string, format string) (*Config, error) {
 	fileContent, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
+	return ParseConfig(fileContent, format, path)
+}
+
+// ParseConfig creates a new configuration from the content of a json, yaml or toml document found at path, a file
+// path or a url. The format is detected from the extension of the path unless it is set explicitly.
+// Environment variable and file references in the string values are resolved, and the targets of the targets
+// database, if any, are added to the ones of the document, as well as the targets of the included fragment files.
+// Unknown fields are rejected, so a misspelled stanza fails the parsing rather than being silently ignored, and the
+// parsed configuration is validated.
+func ParseConfig(fileContent []byte, format string, path string) (*Config, error) {
+	return parseConfig(fileContent, format, path, true)
+}
+
+// parseConfig parses the configuration like ParseConfig does. Unless the document is trusted, its references are left
+// as they are and the fields reading or writing local resources are rejected, see checkUntrusted.
+func parseConfig(fileContent []byte, format string, path string, trusted bool) (*Config, error) {
 	var data Config
-	err = json.Unmarshal(fileContent, &data)
+	interpolatedPaths, err := decodeDocument(fileContent, format, path, trusted, &data)
 	if err != nil {
-		mylogger.MainLogger.Errorf("Failed parsing config at path: %s with error: %s", path, err)
+		return nil, err
+	}
+	if !trusted {
+		err = data.checkUntrusted()
+		if err != nil {
+			mylogger.MainLogger.Errorf("Invalid config at path: %s with error: %s", path, err)
+			return nil, err
+		}
+	}
+	data.interpolatedPaths = interpolatedPaths
+	err = data.loadIncludes(path)
+	if err != nil {
+		return nil, err
+	}
+	if data.TargetsDB != nil {
+		err = data.TargetsDB.validate()
+		if err != nil {
+			return nil, err
+		}
+		targets, err := LoadTargetsDB(*data.TargetsDB)
+		if err != nil {
+			mylogger.MainLogger.Errorf("Failed loading targets from db: %s with error: %s", data.TargetsDB.Driver, err)
+			return nil, err
+		}
+		data.Targets = append(data.Targets, targets...)
+	}
+	err = data.Validate()
+	if err != nil {
+		mylogger.MainLogger.Errorf("Invalid config at path: %s with error: %s", path, err)
 		return nil, err
 	}
 	return &data, err
+}
+
+// decodeDocument decodes a json, yaml or toml document into v, after resolving its references when interpolation is
+// set. It returns the paths of the values resolved from references.
+func decodeDocument(content []byte, format string, path string, interpolation bool, v interface{}) ([]configPath, error) {
+	format, err := configFormat(path, format)
+	if err != nil {
+		return nil, err
+	}
+	content, err = toJSON(content, format)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Failed parsing %s config at path: %s with error: %s", format, path, err)
+		return nil, err
+	}
+	var interpolatedPaths []configPath
+	if interpolation {
+		content, interpolatedPaths, err = interpolate(content, reflect.TypeOf(v))
+		if err != nil {
+			mylogger.MainLogger.Errorf("Failed resolving references in config at path: %s with error: %s", path, err)
+			return nil, err
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(v)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Failed parsing config at path: %s with error: %s", path, err)
+		return nil, err
+	}
+	return interpolatedPaths, nil
+}
+
+// Validate checks the consistency of the configuration: every metrics database stanza configures exactly one
+// database, target ids are unique, prober ids are unique within their target and the intervals are valid.
+// The prober contexts are specific to every type of prober, they are not validated here. All problems are reported.
+func (c *Config) Validate() error {
+	var errs []error
+	if len(c.TimeSeriesDB) == 0 {
+		errs = append(errs, fmt.Errorf("no metrics database configured"))
+	}
+	for i, db := range c.TimeSeriesDB {
+		configured := 0
+		for _, stanza := range []bool{db.InfluxDBSubConfig != nil, db.InfluxDB2SubConfig != nil,
+			db.MySQLDBSubConfig != nil, db.PrometheusSubConfig != nil, db.OTLPSubConfig != nil,
+			db.StatsDSubConfig != nil, db.GraphiteSubConfig != nil} {
+			if stanza {
+				configured++
+			}
+		}
+		if configured != 1 {
+			errs = append(errs, fmt.Errorf("metrics_db[%d] must configure exactly one database, got %d", i, configured))
+		}
+	}
+
+	targetIDs := make(map[string]bool)
+	for i, target := range c.Targets {
+		if target.Id == "" {
+			errs = append(errs, fmt.Errorf("targets[%d] has no id", i))
+		} else if targetIDs[target.Id] {
+			errs = append(errs, fmt.Errorf("duplicate target id: %s", target.Id))
+		}
+		targetIDs[target.Id] = true
+
+		proberIDs := make(map[string]bool)
+		for j, prober := range target.Probers {
+			if prober.Id == "" {
+				errs = append(errs, fmt.Errorf("prober %d of target %s has no id", j, target.Id))
+			} else if proberIDs[prober.Id] {
+				errs = append(errs, fmt.Errorf("duplicate prober id: %s in target %s", prober.Id, target.Id))
+			}
+			proberIDs[prober.Id] = true
+			if prober.Name == "" {
+				errs = append(errs, fmt.Errorf("prober %s of target %s has no type", prober.Id, target.Id))
+			}
+			_, err := prober.ProbeInterval(target)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid interval of prober %s in target %s: %w", prober.Id, target.Id, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
 }
\ No newline at end of file
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"inspector/mylogger"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Implementation of a remote configuration source, fetching the configuration document from an http(s) url, so a
+ * fleet of inspectors can share a central configuration.
+ * The document is polled with conditional requests (If-None-Match and If-Modified-Since), unchanged documents are
+ * not reprocessed. Requests can be authenticated with a bearer token. When a signing key is set, documents must be
+ * signed with HMAC-SHA256, the hex encoded signature being sent in the X-Inspector-Signature header as
+ * "sha256=<signature>". Documents failing the verification are rejected.
+ * Without a signing key, anyone able to serve the document could read the environment and the files of the host, or
+ * send them elsewhere. The references of unsigned documents are not resolved, the fields using local files, databases
+ * or directories are refused, and so are plain http urls.
+ */
+
+var REMOTE_CONFIG_DEFAULT_POLL_INTERVAL = time.Minute
+var REMOTE_CONFIG_TIMEOUT = 30 * time.Second
+
+// REMOTE_CONFIG_MAX_SIZE bounds the size of the fetched documents.
+var REMOTE_CONFIG_MAX_SIZE int64 = 10 * 1024 * 1024
+
+const REMOTE_CONFIG_SIGNATURE_HEADER = "X-Inspector-Signature"
+
+type RemoteSource struct {
+	url          string
+	token        string
+	signingKey   []byte
+	pollInterval time.Duration
+	client       *http.Client
+	lock         sync.Mutex
+	content      []byte
+	etag         string
+	lastModified string
+}
+
+// IsRemoteConfig tells whether the config path is a url rather than a file path.
+func IsRemoteConfig(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// NewRemoteSource creates a source for the document at the url and fetches it. The bearer token and the signing key
+// are read from files, empty paths disable authentication and signature verification. Plain http urls require a
+// signing key.
+func NewRemoteSource(url string, pollInterval time.Duration, tokenFile string, signingKeyFile string) (*RemoteSource, error) {
+	if strings.HasPrefix(url, "http://") && signingKeyFile == "" {
+		return nil, fmt.Errorf("config url %s is not https, a signing key is required", url)
+	}
+	source := &RemoteSource{
+		url:          url,
+		pollInterval: pollInterval,
+		client:       &http.Client{Timeout: REMOTE_CONFIG_TIMEOUT},
+	}
+	if source.pollInterval <= 0 {
+		source.pollInterval = REMOTE_CONFIG_DEFAULT_POLL_INTERVAL
+	}
+	if tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading the config token: %w", err)
+		}
+		source.token = strings.TrimSpace(string(token))
+	}
+	if signingKeyFile != "" {
+		signingKey, err := os.ReadFile(signingKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading the config signing key: %w", err)
+		}
+		source.signingKey = bytes.TrimRight(signingKey, "\r\n")
+	}
+	_, err := source.fetch()
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// Content returns the last fetched document.
+func (source *RemoteSource) Content() []byte {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	return source.content
+}
+
+// Config parses the last fetched document. Its references are only resolved when the document is signed, and unsigned
+// documents must not use local resources.
+func (source *RemoteSource) Config(format string) (*Config, error) {
+	return parseConfig(source.Content(), format, source.url, source.signingKey != nil)
+}
+
+// checkUntrusted rejects the fields of an unsigned document giving access to local resources: the include globs, the
+// targets database, the metrics spools, and the body and tls files of the probers. All of them are reported.
+func (c *Config) checkUntrusted() error {
+	var errs []error
+	refuse := func(field string) {
+		errs = append(errs, fmt.Errorf("%s is not allowed in an unsigned remote config", field))
+	}
+	if len(c.Include) > 0 {
+		refuse("include")
+	}
+	if c.TargetsDB != nil {
+		refuse("targets_db")
+	}
+	for i, db := range c.TimeSeriesDB {
+		if (db.InfluxDBSubConfig != nil && db.InfluxDBSubConfig.Spool != nil) ||
+			(db.InfluxDB2SubConfig != nil && db.InfluxDB2SubConfig.Spool != nil) {
+			refuse(fmt.Sprintf("metrics_db[%d] spool", i))
+		}
+	}
+	for i, target := range c.Targets {
+		for j, prober := range target.Probers {
+			field := fmt.Sprintf("targets[%d].probers[%d].context", i, j)
+			if prober.Context.BodyFile != "" {
+				refuse(field + ".body_file")
+			}
+			if tls := prober.Context.TLS; tls != nil && (tls.CAFile != "" || tls.CertFile != "" || tls.KeyFile != "") {
+				refuse(field + ".tls files")
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Watch polls the url and sends an event to the channel whenever the document changes. Failing polls are logged and
+// retried on the next poll, the last fetched document stays in use.
+func (source *RemoteSource) Watch(events chan<- string) {
+	ticker := time.NewTicker(source.pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		changed, err := source.fetch()
+		if err != nil {
+			mylogger.MainLogger.Errorf("Failed fetching config from: %s, error: %s", source.url, err)
+			continue
+		}
+		if changed {
+			events <- "Remote change: " + source.url
+		}
+	}
+}
+
+// fetch requests the document unless it was not modified since the last fetch. It tells whether the document changed.
+func (source *RemoteSource) fetch() (bool, error) {
+	request, err := http.NewRequest(http.MethodGet, source.url, nil)
+	if err != nil {
+		return false, err
+	}
+	source.lock.Lock()
+	if source.etag != "" {
+		request.Header.Set("If-None-Match", source.etag)
+	}
+	if source.lastModified != "" {
+		request.Header.Set("If-Modified-Since", source.lastModified)
+	}
+	source.lock.Unlock()
+	if source.token != "" {
+		request.Header.Set("Authorization", "Bearer "+source.token)
+	}
+
+	response, err := source.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status: %s", response.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(response.Body, REMOTE_CONFIG_MAX_SIZE+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(content)) > REMOTE_CONFIG_MAX_SIZE {
+		return false, fmt.Errorf("config is larger than %d bytes", REMOTE_CONFIG_MAX_SIZE)
+	}
+	err = source.verify(content, response.Header.Get(REMOTE_CONFIG_SIGNATURE_HEADER))
+	if err != nil {
+		return false, err
+	}
+
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	source.etag = response.Header.Get("ETag")
+	source.lastModified = response.Header.Get("Last-Modified")
+	// Servers without conditional requests support send the same document again.
+	if source.content != nil && bytes.Equal(source.content, content) {
+		return false, nil
+	}
+	source.content = content
+	return true, nil
+}
+
+// verify checks the signature of the document, when a signing key is set.
+func (source *RemoteSource) verify(content []byte, signature string) error {
+	if source.signingKey == nil {
+		return nil
+	}
+	encoded, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return fmt.Errorf("config is not signed")
+	}
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid config signature: %w", err)
+	}
+	mac := hmac.New(sha256.New, source.signingKey)
+	mac.Write(content)
+	if !hmac.Equal(decoded, mac.Sum(nil)) {
+		return fmt.Errorf("config signature does not match")
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"inspector/mylogger"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	glogger "github.com/google/logger"
+)
+
+func init() {
+	if mylogger.MainLogger == nil {
+		mylogger.MainLogger = glogger.Init("InspectorTestLogger", false, false, io.Discard)
+	}
+}
+
+const remoteConfigWithBodyFile = `{
+	"metrics_db": [{"statsd": {"address": "127.0.0.1", "port": 8125}}],
+	"targets": [{
+		"id": "website",
+		"name": "website",
+		"probers": [{
+			"id": "upload",
+			"name": "http",
+			"context": {"url": "https://collector.example.com", "method": "POST", "body_file": "/run/secrets/token"}
+		}]
+	}]
+}`
+
+// startConfigServer serves the document over https, the default transport trusting the certificate of the server for
+// the duration of the test.
+func startConfigServer(t *testing.T, document string) string {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, document)
+	}))
+	t.Cleanup(server.Close)
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	t.Cleanup(func() { http.DefaultTransport = defaultTransport })
+	return server.URL + "/config.json"
+}
+
+func TestUnsignedRemoteConfigRefusesBodyFile(t *testing.T) {
+	source, err := NewRemoteSource(startConfigServer(t, remoteConfigWithBodyFile), 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = source.Config("")
+	if err == nil {
+		t.Fatal("unsigned config with a body_file was accepted")
+	}
+	if !strings.Contains(err.Error(), "body_file") {
+		t.Errorf("error does not mention body_file: %s", err)
+	}
+}
+
+func TestUnsignedRemoteConfigAcceptsInlineBody(t *testing.T) {
+	document := strings.Replace(remoteConfigWithBodyFile, `"body_file": "/run/secrets/token"`, `"body": "{}"`, 1)
+	source, err := NewRemoteSource(startConfigServer(t, document), 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = source.Config("")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlainHTTPRemoteConfigRequiresSigningKey(t *testing.T) {
+	_, err := NewRemoteSource("http://127.0.0.1:1/config.json", 0, "", "")
+	if err == nil {
+		t.Fatal("plain http config url without a signing key was accepted")
+	}
+}
@@ -0,0 +1,222 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"inspector/config"
+	"inspector/metrics"
+	"inspector/mylogger"
+	"inspector/probers"
+)
+
+/*
+ * Engine runs every configured prober on its own timer. Each prober gets a dedicated goroutine which wakes up on the
+ * prober's interval, creates a fresh prober and drives it through the Prober interface lifecycle.
+ * Runs of the same prober never overlap: if a run takes longer than the interval, the missed ticks are skipped.
+ * On config reloads the engine reconciles the scheduled probers with the new config, by target and prober id: only the
+ * added, removed and modified probers are started or stopped, the others keep running on their current schedule.
+ */
+
+// PROBER_START_JITTER_RANGE spreads the first run of the probers so they don't all fire at the same moment.
+var PROBER_START_JITTER_RANGE = 2 * time.Second
+
+type Engine struct {
+	metricsChannel chan metrics.SingleMetric
+	// Scheduled probers by target and prober id.
+	runners map[string]*proberRunner
+}
+
+// proberRunner holds the state of a single scheduled prober.
+type proberRunner struct {
+	target   config.TargetSubConfig
+	prober   config.ProberSubConfig
+	interval time.Duration
+	// Closed once the runner this one replaces has stopped, so the runs of the two never overlap. Nil when there is
+	// nothing to wait for.
+	after <-chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewEngine(metricsChannel chan metrics.SingleMetric) *Engine {
+	return &Engine{
+		metricsChannel: metricsChannel,
+		runners:        make(map[string]*proberRunner),
+	}
+}
+
+// Start schedules every prober of every target in the config. Probers with an invalid interval are skipped.
+func (e *Engine) Start(c *config.Config) {
+	e.Reload(c)
+}
+
+// Reload reconciles the scheduled probers with the config. New probers are started, removed ones are stopped and
+// modified ones are restarted, once their in-flight run is over. Unchanged probers keep running undisturbed.
+// Probers with an invalid interval are skipped.
+func (e *Engine) Reload(c *config.Config) {
+	wanted := make(map[string]bool)
+	for _, target := range c.Targets {
+		for _, proberSubConfig := range target.Probers {
+			interval, err := proberSubConfig.ProbeInterval(target)
+			if err != nil {
+				mylogger.MainLogger.Errorf("Invalid interval for prober: %s for target: %s, error: %s",
+					proberSubConfig.Name, target.Name, err)
+				continue
+			}
+			key := runnerKey(target, proberSubConfig)
+			wanted[key] = true
+
+			var after <-chan struct{}
+			current, ok := e.runners[key]
+			if ok {
+				if current.unchanged(target, proberSubConfig, interval) {
+					continue
+				}
+				close(current.stop)
+				after = current.done
+				mylogger.MainLogger.Infof("Restarting modified prober: %s for target: %s",
+					proberSubConfig.Name, target.Name)
+			}
+			r := &proberRunner{
+				target:   target,
+				prober:   proberSubConfig,
+				interval: interval,
+				after:    after,
+				stop:     make(chan struct{}),
+				done:     make(chan struct{}),
+			}
+			e.runners[key] = r
+			go r.loop(e.metricsChannel)
+			mylogger.MainLogger.Infof("Scheduled prober: %s for target: %s every %s",
+				proberSubConfig.Name, target.Name, interval)
+		}
+	}
+
+	for key, r := range e.runners {
+		if wanted[key] {
+			continue
+		}
+		close(r.stop)
+		delete(e.runners, key)
+		mylogger.MainLogger.Infof("Stopped removed prober: %s for target: %s", r.prober.Name, r.target.Name)
+	}
+}
+
+// ValidateProbers creates and initializes every prober of the config, without connecting nor running them, to catch
+// the invalid prober contexts before the config is applied. Initialization does not hold any resources, the probers
+// are simply dropped afterwards. All problems are reported.
+func ValidateProbers(c *config.Config) error {
+	var errs []error
+	for _, target := range c.Targets {
+		for _, proberSubConfig := range target.Probers {
+			prober, err := probers.NewProber(proberSubConfig)
+			if err == nil {
+				err = prober.Initialize(target.Id, proberSubConfig.Id)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid prober %s in target %s: %w", proberSubConfig.Id, target.Id, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Stop stops all scheduled probers and waits for the in-flight runs to finish.
+func (e *Engine) Stop() {
+	for _, r := range e.runners {
+		close(r.stop)
+	}
+	for _, r := range e.runners {
+		<-r.done
+	}
+	e.runners = make(map[string]*proberRunner)
+}
+
+// runnerKey identifies a prober across config reloads.
+func runnerKey(target config.TargetSubConfig, prober config.ProberSubConfig) string {
+	return target.Id + "/" + prober.Id
+}
+
+// unchanged tells whether the runner already runs the prober as configured. Only the target fields the runner uses
+// are compared, changes to the target's other probers do not matter.
+func (r *proberRunner) unchanged(target config.TargetSubConfig, prober config.ProberSubConfig, interval time.Duration) bool {
+	return r.target.Name == target.Name && r.interval == interval && reflect.DeepEqual(r.prober, prober)
+}
+
+func (r *proberRunner) loop(metricsChannel chan metrics.SingleMetric) {
+	defer close(r.done)
+
+	if r.after != nil {
+		select {
+		case <-r.after:
+		case <-r.stop:
+			return
+		}
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(PROBER_START_JITTER_RANGE)))
+	select {
+	case <-time.After(jitter):
+	case <-r.stop:
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.runOnce(metricsChannel)
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// runOnce creates a new prober and runs it through initialization, connection, the probe itself and tear down.
+// Probers are not reused between runs.
+func (r *proberRunner) runOnce(metricsChannel chan metrics.SingleMetric) {
+	target, proberSubConfig := r.target, r.prober
+
+	prober, err := probers.NewProber(proberSubConfig)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Failed creating new prober: %s for target: %s, error: %s",
+			proberSubConfig.Name, target.Name, err)
+		return
+	}
+	err = prober.Initialize(target.Id, proberSubConfig.Id)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Failed initializing prober: %s for target: %s, error: %s",
+			proberSubConfig.Name, target.Name, err)
+		return
+	}
+	mylogger.MainLogger.Infof("Successfully initialized prober: %s for target: %s",
+		proberSubConfig.Name, target.Name)
+
+	err = prober.Connect(metricsChannel)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Failed prober connection: %s for target: %s, error: %s",
+			proberSubConfig.Name, target.Name, err)
+		return
+	}
+	mylogger.MainLogger.Infof("Successful prober connection: %s for target: %s",
+		proberSubConfig.Name, target.Name)
+
+	err = prober.RunOnce(metricsChannel)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Failed running prober: %s for target: %s, error: %s",
+			proberSubConfig.Name, target.Name, err)
+	}
+	err = prober.TearDown()
+	if err != nil {
+		mylogger.MainLogger.Errorf("Failed tearing down prober: %s for target: %s, error: %s",
+			proberSubConfig.Name, target.Name, err)
+		return
+	}
+	mylogger.MainLogger.Infof("Successfully torn down prober: %s for target: %s",
+		proberSubConfig.Name, target.Name)
+}
@@ -3,30 +3,38 @@ package main
 import (
 	"flag"
 	"io"
-	"math/rand"
 	"os"
+	"reflect"
+	"sync/atomic"
 	"time"
 
 	glogger "github.com/google/logger"
 
 	"inspector/config"
+	"inspector/engine"
 	"inspector/metrics"
 	"inspector/mylogger"
-	"inspector/probers"
 	"inspector/scheduler"
 	"inspector/watcher"
 )
 
 
 var METRIC_CHANNEL_POLL_INTERVAL = 10 * time.Second
-var TARGET_LIST_SCAN_WAIT_INTERVAL = 4 * time.Second
-var PROBER_RESTART_INTERVAL_JITTER_RANGE = 2
 var METRIC_CHANNEL_SIZE = 400
 
 func main() {
 
-	var configPath = flag.String("config_path", "", "Path to the configuration file. Mandatory argument.")
+	var configPath = flag.String("config_path", "", "Path or http(s) url of the configuration file. Mandatory argument.")
 	var logFilePath = flag.String("log_path", "", "A file where to write logs. Optional argument, defaults to stdout")
+	var configFormat = flag.String("config_format", "", "Format of the configuration file: json, yaml or toml. "+
+		"Optional argument, defaults to the format of the file extension, json for other extensions")
+	var configPollInterval = flag.Duration("config_poll_interval", config.REMOTE_CONFIG_DEFAULT_POLL_INTERVAL,
+		"How often a configuration url is checked for changes. Optional argument")
+	var configTokenFile = flag.String("config_token_file", "", "A file holding the bearer token sent when fetching a "+
+		"configuration url. Optional argument")
+	var configSigningKeyFile = flag.String("config_signing_key_file", "", "A file holding the HMAC-SHA256 key the "+
+		"configuration fetched from a url must be signed with. Optional argument, defaults to no verification. "+
+		"Required for http urls, unsigned configurations can neither use references nor local files")
 
 	flag.Parse()
 
@@ -46,15 +54,31 @@ func main() {
 			"supported arguments")
 		os.Exit(1)
 	}
-	c, err := config.NewConfig(*configPath)
+	// The configuration is either a local file or fetched from a url.
+	var remoteSource *config.RemoteSource
+	loadConfig := func() (*config.Config, error) {
+		if remoteSource != nil {
+			return remoteSource.Config(*configFormat)
+		}
+		return config.NewConfig(*configPath, *configFormat)
+	}
+	if config.IsRemoteConfig(*configPath) {
+		var err error
+		remoteSource, err = config.NewRemoteSource(*configPath, *configPollInterval, *configTokenFile,
+			*configSigningKeyFile)
+		if err != nil {
+			mylogger.MainLogger.Errorf("Error fetching config: %s", err)
+			os.Exit(1)
+		}
+	}
+	c, err := loadConfig()
 	if err != nil {
 		mylogger.MainLogger.Infof("Error reading config: %s", err)
 		os.Exit(1)
 	}
-	mylogger.MainLogger.Infof("Config parsed: %v", c.TimeSeriesDB[0])
+	mylogger.MainLogger.Infof("Config parsed: %v", c)
 
-	//TODO: enable support for multiple time series databases. For now only the first one is used from config.
-	mdb, err := metrics.NewMetricsDB(c.TimeSeriesDB[0])
+	mdb, err := metrics.NewMultiMetricsDB(c.TimeSeriesDB)
 	if err != nil {
 		mylogger.MainLogger.Infof("Failed initializing metrics db client with error: %s", err)
 		os.Exit(1)
@@ -63,13 +87,48 @@ func main() {
 
 	// Tracking the config to be able to inform the inspector about changes, this makes the inspector self-updating while running.
 	configEventChannel := make(chan string)
-	go func() {
-        err := watcher.WatchFile(*configPath, configEventChannel)
-        if err != nil {
-            mylogger.MainLogger.Errorf("Error watching file: %s", err)
-            return
-        }
-    }() 
+	// The watcher of a local config file watches the include directories as well, it is restarted when they change.
+	var stopWatcher chan struct{}
+	watchConfigFile := func(includes []string) {
+		if stopWatcher != nil {
+			close(stopWatcher)
+		}
+		stop := make(chan struct{})
+		stopWatcher = stop
+		go func() {
+			err := watcher.WatchFile(*configPath, includes, configEventChannel, stop)
+			if err != nil {
+				mylogger.MainLogger.Errorf("Error watching file: %s", err)
+				return
+			}
+		}()
+	}
+	if remoteSource != nil {
+		go remoteSource.Watch(configEventChannel)
+	} else {
+		watchConfigFile(c.IncludePatterns())
+	}
+
+	// The targets database, if any, is polled for changes, which are reported on the config event channel as well.
+	var stopTargetsDB chan struct{}
+	watchTargetsDB := func(targetsDB *config.TargetsDBSubConfig) {
+		if stopTargetsDB != nil {
+			close(stopTargetsDB)
+			stopTargetsDB = nil
+		}
+		if targetsDB == nil {
+			return
+		}
+		stop := make(chan struct{})
+		stopTargetsDB = stop
+		go func() {
+			err := config.WatchTargetsDB(*targetsDB, configEventChannel, stop)
+			if err != nil {
+				mylogger.MainLogger.Errorf("Error watching targets db: %s", err)
+			}
+		}()
+	}
+	watchTargetsDB(c.TargetsDB)
 
 	// TODO: determine what should the size of the channel be ?
 	metricsChannel := make(chan metrics.SingleMetric, METRIC_CHANNEL_SIZE)
@@ -97,99 +156,68 @@ func main() {
 	 * Kick off an async  metrics collection from the metrics channel. Metrics are pushed into the metrics channel
 	 * by probers. Collected metrics are pushed out to the currently configured metrics database.
 	 */
+	// The region is read by the metrics goroutine while config reloads replace the config.
+	var region atomic.Value
+	region.Store(c.Inspector.Region)
 	go func() {
 		ticker := time.NewTicker(METRIC_CHANNEL_POLL_INTERVAL)
 		defer ticker.Stop()
 		for {
 			select {
 			case m := <-metricsChannel:
-				m.Tags["region"] = c.Inspector.Region
+				m.Tags["region"] = region.Load().(string)
 				mdb.CollectMetrics(m)
 			case <-ticker.C:
 				mylogger.MainLogger.Infof("Metrics channel is empty. Emitting metrics...")
+				failed := metrics.CreateSingleMetric("metrics_db_failed_backends", float64(len(mdb.FailedBackends())),
+					nil, map[string]string{"region": region.Load().(string)})
+				mdb.CollectMetrics(failed)
 				mdb.EmitMultiple()
 			}
 		}
 	}()
 
 	/*
-	 * Iterate over every target defined in the config, and per each target asynchronously initialize and run configured
-	 * probers. Each prober will inject metrics into the metrics channel. The probers are expected to be implemented
-	 * using the Prober interface.
-	 * Probers are not reused and run only once per iteration.
+	 * Schedule every prober defined in the config. Each prober runs on its own interval and injects metrics into the
+	 * metrics channel. The probers are expected to be implemented using the Prober interface.
 	 *
-	 * TODO: as a further optimization, the targets can be partitioned and processed asynchronously. This will help
+	 * TODO: as a further optimization, the targets can be partitioned across inspector instances. This will help
 	 *       if the number of targets become extremely large, but for now it's not a priority.
 	 */
-	for {
-		// Monitor configEventChannel to know about config changes. For current state of Inspector we interested only in "Write" event.
-		select {
-		case event := <-configEventChannel:
-			mylogger.MainLogger.Infof("Config event: %s", event)
-			c, err = config.NewConfig(*configPath)
-			if err != nil {
-				mylogger.MainLogger.Infof("Error reading config: %s", err)
-				os.Exit(1)
-			}
-			mylogger.MainLogger.Infof("Config parsed: %v", c.TimeSeriesDB[0])
-			mdb, err = metrics.NewMetricsDB(c.TimeSeriesDB[0])
-			if err != nil {
-				mylogger.MainLogger.Infof("Failed initializing metrics db client with error: %s", err)
-				os.Exit(1)
-			}
-			mylogger.MainLogger.Infof("Initialized metrics database...")
-		default:
-			mylogger.MainLogger.Infof("No config event.")
+	proberEngine := engine.NewEngine(metricsChannel)
+	proberEngine.Start(c)
+
+	// Monitor configEventChannel to know about config changes. For current state of Inspector we interested only in "Write" event.
+	// A config which fails to load is not applied, the inspector keeps running on the last good one.
+	for event := range configEventChannel {
+		mylogger.MainLogger.Infof("Config event: %s", event)
+		newConfig, err := loadConfig()
+		if err == nil {
+			err = engine.ValidateProbers(newConfig)
+		}
+		if err != nil {
+			mylogger.MainLogger.Errorf("Error reading config, keeping the previous one: %s", err)
+			metricsChannel <- metrics.CreateSingleMetric("config_reload_success", 0, nil, map[string]string{})
+			continue
 		}
+		mylogger.MainLogger.Infof("Config parsed: %v", newConfig)
+		// The metrics databases failing to initialize are skipped and retried on the next reload, they are reported by
+		// the metrics_db_failed_backends metric.
+		err = mdb.Reload(newConfig.TimeSeriesDB)
+		if err != nil {
+			mylogger.MainLogger.Errorf("Failed initializing metrics db client, continuing without it: %s", err)
+		}
+		mylogger.MainLogger.Infof("Initialized metrics database...")
 
-		for _, target := range c.Targets {
-			for _, proberSubConfig := range target.Probers {
-				go func() {
-					prober, err := probers.NewProber(proberSubConfig)
-					if err != nil {
-						mylogger.MainLogger.Errorf("Failed creating new prober: %s for target: %s, error: %s",
-							proberSubConfig.Name, target.Name, err)
-						return
-					}
-					err = prober.Initialize(target.Id, proberSubConfig.Id)
-					if err != nil {
-						mylogger.MainLogger.Errorf("Failed initializing prober: %s for target: %s, error: %s",
-							proberSubConfig.Name, target.Name, err)
-						return
-					}
-					mylogger.MainLogger.Infof("Successfully initialized prober: %s for target: %s",
-						proberSubConfig.Name, target.Name)
-
-					err = prober.Connect(metricsChannel)
-					if err != nil {
-						mylogger.MainLogger.Errorf("Failed prober connection: %s for target: %s, error: %s",
-							proberSubConfig.Name, target.Name, err)
-						return
-					}
-					mylogger.MainLogger.Infof("Successful prober connection: %s for target: %s",
-						proberSubConfig.Name, target.Name)
-
-					err = prober.RunOnce(metricsChannel)
-					if err != nil {
-						mylogger.MainLogger.Errorf("Failed running prober: %s for target: %s, error: %s",
-							proberSubConfig.Name, target.Name, err)
-						return
-					}
-					err = prober.TearDown()
-					if err != nil {
-						mylogger.MainLogger.Errorf("Failed tearing down prober: %s for target: %s, error: %s",
-							proberSubConfig.Name, target.Name, err)
-						return
-					}
-					mylogger.MainLogger.Infof("Successfully torn down prober: %s for target: %s",
-						proberSubConfig.Name, target.Name)
-				}()
-
-				jitter := rand.Intn(PROBER_RESTART_INTERVAL_JITTER_RANGE)
-				time.Sleep(time.Duration(jitter) * time.Second)
-			}
+		if !reflect.DeepEqual(c.TargetsDB, newConfig.TargetsDB) {
+			watchTargetsDB(newConfig.TargetsDB)
+		}
+		if remoteSource == nil && !reflect.DeepEqual(c.IncludePatterns(), newConfig.IncludePatterns()) {
+			watchConfigFile(newConfig.IncludePatterns())
 		}
-		// Wait before scanning through the targets from scratch
-		time.Sleep(TARGET_LIST_SCAN_WAIT_INTERVAL)
+		c = newConfig
+		region.Store(c.Inspector.Region)
+		proberEngine.Reload(c)
+		metricsChannel <- metrics.CreateSingleMetric("config_reload_success", 1, nil, map[string]string{})
 	}
 }
@@ -4,41 +4,142 @@ import (
 	"fmt"
 	"inspector/config"
 	"inspector/mylogger"
+	"time"
 )
 
 type SingleMetric struct {
 	Name             string
-	Value            int64
+	Value            float64
 	AdditionalFields map[string]interface{}
 	Tags             map[string]string
+	// Timestamp is the time the metric was measured at, backends export it instead of the time they receive it.
+	Timestamp time.Time
 }
 
+// outcomeTags describe the outcome of a probe rather than what is probed. They are not part of the series identity, so
+// failed and successful probes update the same series.
+var outcomeTags = map[string]bool{"failed_assertion": true, "failed_stage": true}
+
 type MetricsDB interface {
 	InitializeClient(addr string, port int, database string) error
 	EmitSingle(m SingleMetric)
 	CollectMetrics(m SingleMetric)
 	EmitMultiple()
+	// Close releases the resources held by the client, like connections or listeners.
+	Close() error
 }
 
-func CreateSingleMetric(name string, value int64, additionalFields map[string]interface{}, tags map[string]string) SingleMetric {
+// CreateSingleMetric creates a metric measured now.
+func CreateSingleMetric(name string, value float64, additionalFields map[string]interface{}, tags map[string]string) SingleMetric {
 	return SingleMetric{
 		Name:             name,
 		Value:            value,
 		AdditionalFields: additionalFields,
 		Tags:             tags,
+		Timestamp:        time.Now(),
+	}
+}
+
+// Milliseconds converts a duration into fractional milliseconds, the unit of the latency metrics. Unlike
+// time.Duration.Milliseconds it does not truncate sub-millisecond latencies.
+func Milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// measuredAt returns the timestamp of the metric, or the current time for metrics created without one.
+func (m SingleMetric) measuredAt() time.Time {
+	if m.Timestamp.IsZero() {
+		return time.Now()
 	}
+	return m.Timestamp
 }
 
 // NewMetricsDB initializes a metrics database specified by the config. It returns an object that implements the MetricsDB
-// interface. Currently only InfluxDB is supported.
+// interface. Currently InfluxDB (1.x and 2.x), MySQL, Prometheus, OTLP collectors,
+// StatsD (and DogStatsD) and Graphite are supported.
 func NewMetricsDB(c config.MetricsDBSubConfig) (MetricsDB, error) {
 	var mdb MetricsDB
 	if c.InfluxDBSubConfig != nil {
-		mdb = &InfluxDB{}
+		mdb = &InfluxDB{
+			protocol:    c.InfluxDBSubConfig.Protocol,
+			spoolConfig: c.InfluxDBSubConfig.Spool,
+		}
 		err := mdb.InitializeClient(c.InfluxDBSubConfig.DatabaseURL, c.InfluxDBSubConfig.Port, c.InfluxDBSubConfig.DatabaseName)
 		if err != nil {
 			return nil, err
 		}
+	} else if c.InfluxDB2SubConfig != nil {
+		mdb = &InfluxDB2{
+			protocol:     c.InfluxDB2SubConfig.Protocol,
+			organization: c.InfluxDB2SubConfig.Organization,
+			token:        c.InfluxDB2SubConfig.Token,
+			gzip:         c.InfluxDB2SubConfig.Gzip,
+			spoolConfig:  c.InfluxDB2SubConfig.Spool,
+		}
+		err := mdb.InitializeClient(c.InfluxDB2SubConfig.DatabaseURL, c.InfluxDB2SubConfig.Port, c.InfluxDB2SubConfig.Bucket)
+		if err != nil {
+			return nil, err
+		}
+	} else if c.MySQLDBSubConfig != nil {
+		var retention time.Duration
+		if c.MySQLDBSubConfig.Retention != "" {
+			var err error
+			retention, err = time.ParseDuration(c.MySQLDBSubConfig.Retention)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mysqldb retention: %w", err)
+			}
+		}
+		mdb = &MySQLDB{
+			username:  c.MySQLDBSubConfig.Username,
+			password:  c.MySQLDBSubConfig.Password,
+			retention: retention,
+		}
+		err := mdb.InitializeClient(c.MySQLDBSubConfig.DatabaseURL, c.MySQLDBSubConfig.Port, c.MySQLDBSubConfig.DatabaseName)
+		if err != nil {
+			return nil, err
+		}
+	} else if c.PrometheusSubConfig != nil {
+		mdb = &Prometheus{
+			path:      c.PrometheusSubConfig.Path,
+			buckets:   c.PrometheusSubConfig.HistogramBuckets,
+			seriesTTL: c.PrometheusSubConfig.SeriesTTL,
+		}
+		err := mdb.InitializeClient(c.PrometheusSubConfig.ListenAddress, c.PrometheusSubConfig.Port, "")
+		if err != nil {
+			return nil, err
+		}
+	} else if c.OTLPSubConfig != nil {
+		mdb = &OTLP{
+			protocol: c.OTLPSubConfig.Protocol,
+			urlPath:  c.OTLPSubConfig.URLPath,
+			insecure: c.OTLPSubConfig.Insecure,
+			headers:  c.OTLPSubConfig.Headers,
+			gzip:     c.OTLPSubConfig.Gzip,
+		}
+		err := mdb.InitializeClient(c.OTLPSubConfig.CollectorURL, c.OTLPSubConfig.Port, "")
+		if err != nil {
+			return nil, err
+		}
+	} else if c.StatsDSubConfig != nil {
+		mdb = &StatsD{
+			dogStatsD:     c.StatsDSubConfig.DogStatsD,
+			pathTemplate:  c.StatsDSubConfig.PathTemplate,
+			prefix:        c.StatsDSubConfig.Prefix,
+			maxPacketSize: c.StatsDSubConfig.MaxPacketSize,
+		}
+		err := mdb.InitializeClient(c.StatsDSubConfig.Address, c.StatsDSubConfig.Port, "")
+		if err != nil {
+			return nil, err
+		}
+	} else if c.GraphiteSubConfig != nil {
+		mdb = &Graphite{
+			pathTemplate: c.GraphiteSubConfig.PathTemplate,
+			prefix:       c.GraphiteSubConfig.Prefix,
+		}
+		err := mdb.InitializeClient(c.GraphiteSubConfig.Address, c.GraphiteSubConfig.Port, "")
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		mylogger.MainLogger.Errorf("Specified metrics database is not supported in config: %v", c)
 		return nil, fmt.Errorf("MetricsDB defiend in configuration is not supported: %v", c)
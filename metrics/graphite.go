@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"inspector/mylogger"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Implementation of a Graphite metrics backend, writing the plaintext protocol over tcp.
+ * Graphite has no tags, the metric path is built from a template of the metric name and the tags. Tags which are not
+ * part of the template are appended to the path as <tag>.<value> pairs, sorted by tag, so the series told apart by
+ * them, like the certificates of a chain, do not overwrite each other. The tags describing the outcome of a probe,
+ * like failed_assertion, are left out unless the template names them, failed and successful probes share their path.
+ * Additional fields are not exported.
+ */
+
+var GRAPHITE_DEFAULT_PATH_TEMPLATE = "{region}.{target_id}.{prober_id}.{name}"
+var GRAPHITE_WRITE_TIMEOUT = 30 * time.Second
+
+// GRAPHITE_MAX_PENDING_LINES caps the metrics kept in memory while Graphite is unreachable, the oldest are dropped past it.
+var GRAPHITE_MAX_PENDING_LINES = 100000
+
+var graphitePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+var invalidGraphitePathChars = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+type Graphite struct {
+	address      string
+	pathTemplate string
+	prefix       string
+	conn         net.Conn
+	lines        []string
+}
+
+// InitializeClient checks the path template. The connection is established on the first write, and re-established
+// whenever it breaks. The database argument is not used.
+func (graphite *Graphite) InitializeClient(addr string, port int, database string) error {
+	if graphite.pathTemplate == "" {
+		graphite.pathTemplate = GRAPHITE_DEFAULT_PATH_TEMPLATE
+	}
+	if !strings.Contains(graphite.pathTemplate, "{name}") {
+		return fmt.Errorf("graphite path template must contain {name}: %s", graphite.pathTemplate)
+	}
+	graphite.address = net.JoinHostPort(addr, strconv.Itoa(port))
+	graphite.lines = make([]string, 0)
+	return nil
+}
+
+// EmitSingle sends a single metric out right away.
+func (graphite *Graphite) EmitSingle(m SingleMetric) {
+	err := graphite.write([]string{graphite.line(m)})
+	if err != nil {
+		mylogger.MainLogger.Errorf("Error writing to Graphite: %s", err)
+	}
+}
+
+// CollectMetrics accumulates metrics for subsequent sending.
+func (graphite *Graphite) CollectMetrics(m SingleMetric) {
+	graphite.lines = append(graphite.lines, graphite.line(m))
+}
+
+// EmitMultiple sends all accumulated metrics to Graphite. They are kept in memory while Graphite is unreachable, up to
+// GRAPHITE_MAX_PENDING_LINES.
+func (graphite *Graphite) EmitMultiple() {
+	if len(graphite.lines) == 0 {
+		return
+	}
+	err := graphite.write(graphite.lines)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Error writing to Graphite: %s", err)
+		overflow := len(graphite.lines) - GRAPHITE_MAX_PENDING_LINES
+		if overflow > 0 {
+			mylogger.MainLogger.Errorf("Too many pending Graphite metrics, dropping the %d oldest", overflow)
+			graphite.lines = append(graphite.lines[:0], graphite.lines[overflow:]...)
+		}
+		return
+	}
+	// Clear the accumulated metrics after successful sending
+	graphite.lines = graphite.lines[:0]
+}
+
+// Close closes the connection to Graphite.
+func (graphite *Graphite) Close() error {
+	if graphite.conn == nil {
+		return nil
+	}
+	err := graphite.conn.Close()
+	graphite.conn = nil
+	return err
+}
+
+// write sends the lines over the connection, dialing it first if needed. A broken connection is closed, so the next
+// write dials a new one.
+func (graphite *Graphite) write(lines []string) error {
+	if graphite.conn == nil {
+		conn, err := net.DialTimeout("tcp", graphite.address, GRAPHITE_WRITE_TIMEOUT)
+		if err != nil {
+			return err
+		}
+		graphite.conn = conn
+	}
+	var buffer bytes.Buffer
+	for _, line := range lines {
+		buffer.WriteString(line)
+	}
+	graphite.conn.SetWriteDeadline(time.Now().Add(GRAPHITE_WRITE_TIMEOUT))
+	_, err := graphite.conn.Write(buffer.Bytes())
+	if err != nil {
+		graphite.Close()
+	}
+	return err
+}
+
+// line formats the metric in the plaintext protocol: <path> <value> <timestamp>.
+func (graphite *Graphite) line(m SingleMetric) string {
+	return fmt.Sprintf("%s %s %d\n", renderMetricPath(graphite.pathTemplate, graphite.prefix, m),
+		formatMetricValue(m.Value), m.measuredAt().Unix())
+}
+
+// renderMetricPath builds a dot separated metric path from the template, replacing {name} with the metric name and
+// {<tag>} with the value of the tag. The host tag defaults to the hostname. Components left empty by missing tags are
+// dropped. The tags missing from the template are appended as <tag>.<value> pairs, except the outcome tags.
+func renderMetricPath(template string, prefix string, m SingleMetric) string {
+	used := make(map[string]bool)
+	rendered := graphitePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		key := placeholder[1 : len(placeholder)-1]
+		used[key] = true
+		if key == "name" {
+			return sanitizeGraphiteComponent(m.Name)
+		}
+		value, ok := m.Tags[key]
+		if !ok && key == "host" {
+			value, _ = os.Hostname()
+		}
+		return sanitizeGraphiteComponent(value)
+	})
+
+	components := make([]string, 0)
+	if prefix != "" {
+		components = append(components, prefix)
+	}
+	for _, component := range strings.Split(rendered, ".") {
+		if component != "" {
+			components = append(components, component)
+		}
+	}
+
+	unused := make([]string, 0)
+	for key, value := range m.Tags {
+		if !used[key] && !outcomeTags[key] && value != "" {
+			unused = append(unused, key)
+		}
+	}
+	sort.Strings(unused)
+	for _, key := range unused {
+		components = append(components, sanitizeGraphiteComponent(key), sanitizeGraphiteComponent(m.Tags[key]))
+	}
+	return strings.Join(components, ".")
+}
+
+// formatMetricValue formats the value in the shortest decimal form, integers without a fraction.
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// sanitizeGraphiteComponent replaces the characters which would break the path, dots included, by underscores.
+func sanitizeGraphiteComponent(value string) string {
+	return invalidGraphitePathChars.ReplaceAllString(value, "_")
+}
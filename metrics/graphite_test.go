@@ -0,0 +1,25 @@
+package metrics
+
+import "testing"
+
+func TestGraphitePathIgnoresOutcomeTags(t *testing.T) {
+	tags := map[string]string{"region": "eu", "target_id": "website", "prober_id": "homepage"}
+	failedTags := map[string]string{"region": "eu", "target_id": "website", "prober_id": "homepage",
+		"failed_assertion": "status_codes"}
+	for _, template := range []string{GRAPHITE_DEFAULT_PATH_TEMPLATE, "{target_id}.{name}"} {
+		healthy := renderMetricPath(template, "", CreateSingleMetric("success", 1, nil, tags))
+		failed := renderMetricPath(template, "", CreateSingleMetric("success", 0, nil, failedTags))
+		if healthy != failed {
+			t.Errorf("template %s: failed probe path %s differs from the successful one %s", template, failed, healthy)
+		}
+	}
+}
+
+func TestGraphitePathAppendsUnusedTags(t *testing.T) {
+	path := renderMetricPath(GRAPHITE_DEFAULT_PATH_TEMPLATE, "inspector", CreateSingleMetric("cert_expiry", 30, nil,
+		map[string]string{"region": "eu", "target_id": "website", "prober_id": "tls", "cert_index": "1"}))
+	want := "inspector.eu.website.tls.cert_expiry.cert_index.1"
+	if path != want {
+		t.Errorf("path = %s, want %s", path, want)
+	}
+}
@@ -1,31 +1,78 @@
 package metrics
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"github.com/influxdata/influxdb1-client/models"
 	influxdb_client "github.com/influxdata/influxdb1-client/v2"
+	"inspector/config"
+	"inspector/mylogger"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"time"
 )
 
 /*
- * Implementation of metrics collectors.
- * Currently only InfluxDB is supported.
+ * Implementation of the InfluxDB 1.x metrics backend.
+ * Over http(s) the metrics are written in the line protocol to the /write endpoint, so the points InfluxDB rejects can
+ * be told apart from InfluxDB being unavailable. Rejected points are dropped, they would be rejected on every retry.
  */
 
+// INFLUXDB_MAX_PENDING_POINTS caps the points kept in memory while InfluxDB is unreachable, the oldest are dropped past
+// it. It only applies when the points cannot be spooled to disk.
+var INFLUXDB_MAX_PENDING_POINTS = 100000
+
+var INFLUXDB_WRITE_TIMEOUT = 30 * time.Second
+
 type InfluxDB struct {
-	client   influxdb_client.Client
-	addr     string
-	port     int
-	database string
-	metrics  []*influxdb_client.Point
+	// Client of the udp protocol, the http(s) writes go through httpClient.
+	client      influxdb_client.Client
+	httpClient  *http.Client
+	writeURL    string
+	addr        string
+	port        int
+	database    string
+	protocol    string
+	metrics     []*influxdb_client.Point
+	spoolConfig *config.SpoolSubConfig
+	spool       *Spool
+	dropped     int64
 }
 
-// InitializeClient creates a new HTTP based InfluxDB client. This client will be used for the lifetime of the application.
+// InitializeClient creates a new InfluxDB client, speaking the configured transport protocol: http (the default), https
+// or udp. This client will be used for the lifetime of the application.
 func (flxDB *InfluxDB) InitializeClient(addr string, port int, database string) error {
 	var err error
-	flxDB.client, err = influxdb_client.NewHTTPClient(influxdb_client.HTTPConfig{
-		Addr: fmt.Sprintf("http://%s:%d", addr, port),
-	})
+	switch flxDB.protocol {
+	case "", "http", "https":
+		scheme := flxDB.protocol
+		if scheme == "" {
+			scheme = "http"
+		}
+		query := url.Values{}
+		query.Set("db", database)
+		query.Set("precision", "ns")
+		writeURL := url.URL{
+			Scheme:   scheme,
+			Host:     net.JoinHostPort(addr, strconv.Itoa(port)),
+			Path:     "/write",
+			RawQuery: query.Encode(),
+		}
+		flxDB.writeURL = writeURL.String()
+		flxDB.httpClient = &http.Client{Timeout: INFLUXDB_WRITE_TIMEOUT}
+	case "udp":
+		// The database of udp writes is set on the server side.
+		flxDB.client, err = influxdb_client.NewUDPClient(influxdb_client.UDPConfig{
+			Addr: net.JoinHostPort(addr, strconv.Itoa(port)),
+		})
+	default:
+		return fmt.Errorf("unsupported InfluxDB transport protocol: %s", flxDB.protocol)
+	}
 	if err != nil {
 		return err
 	}
@@ -33,11 +80,18 @@ func (flxDB *InfluxDB) InitializeClient(addr string, port int, database string)
 	flxDB.addr = addr
 	flxDB.database = database
 	flxDB.metrics = make([]*influxdb_client.Point, 0)
+	if flxDB.spoolConfig != nil {
+		flxDB.spool, err = OpenSpool(*flxDB.spoolConfig)
+		if err != nil {
+			flxDB.Close()
+			return err
+		}
+	}
 	return nil
 }
 
-// EmitSingle sends a single metric out using the current InfluxDB client. It adds the source host where the metric is coming from.
-func (flxDB *InfluxDB) EmitSingle(m SingleMetric) {
+// newInfluxPoint converts the metric into an InfluxDB point. It adds the source host where the metric is coming from.
+func newInfluxPoint(m SingleMetric) (*influxdb_client.Point, error) {
 	if m.Tags == nil {
 		m.Tags = make(map[string]string)
 		m.Tags["host"], _ = os.Hostname()
@@ -51,80 +105,183 @@ func (flxDB *InfluxDB) EmitSingle(m SingleMetric) {
 		m.AdditionalFields = make(map[string]interface{})
 	}
 	m.AdditionalFields["value"] = m.Value
-	point, err := influxdb_client.NewPoint(m.Name,
+	return influxdb_client.NewPoint(m.Name,
 		m.Tags,
 		m.AdditionalFields,
-		time.Now())
-	if err != nil {
-		fmt.Printf("Error creating point: %s\n", err)
-		return
-	}
+		m.measuredAt())
+}
 
-	bp, err := influxdb_client.NewBatchPoints(influxdb_client.BatchPointsConfig{
-		Database:  flxDB.database,
-		Precision: "ns",
-	})
+// EmitSingle sends a single metric out using the current InfluxDB client.
+func (flxDB *InfluxDB) EmitSingle(m SingleMetric) {
+	point, err := newInfluxPoint(m)
 	if err != nil {
-		fmt.Printf("Error creating batch points: %s\n", err)
+		mylogger.MainLogger.Errorf("Error creating point: %s", err)
 		return
 	}
-	bp.AddPoint(point)
 
-	// Send the batch of points to InfluxDB
-	err = flxDB.client.Write(bp)
+	// Send the point to InfluxDB
+	err = flxDB.write([]*influxdb_client.Point{point})
 	if err != nil {
-		fmt.Printf("Error writing to InfluxDB: %s\n", err)
+		mylogger.MainLogger.Errorf("Error writing to InfluxDB: %s", err)
 	}
 }
 
 // CollectMetrics accumulates metrics for subsequent sending.
 func (flxDB *InfluxDB) CollectMetrics(m SingleMetric) {
-	if m.Tags == nil {
-		m.Tags = make(map[string]string)
-		m.Tags["host"], _ = os.Hostname()
-	}
-	_, ok := m.Tags["host"]
-	if !ok {
-		m.Tags["host"], _ = os.Hostname()
-	}
-	// additionalFields cannot be empty
-	if m.AdditionalFields == nil {
-		m.AdditionalFields = make(map[string]interface{})
-	}
-	m.AdditionalFields["value"] = m.Value
-	point, err := influxdb_client.NewPoint(m.Name,
-		m.Tags,
-		m.AdditionalFields,
-		time.Now())
+	point, err := newInfluxPoint(m)
 	if err != nil {
-		fmt.Printf("Error creating point: %s\n", err)
+		mylogger.MainLogger.Errorf("Error creating point: %s", err)
 		return
 	}
 	flxDB.metrics = append(flxDB.metrics, point)
 }
 
 // EmitMultiple sends all accumulated metrics to InfluxDB in one request.
+// When a spool is configured, metrics which cannot be written are spooled to disk and replayed in order once InfluxDB
+// is reachable again. Otherwise they are kept in memory, up to INFLUXDB_MAX_PENDING_POINTS. Rejected metrics are dropped.
 func (flxDB *InfluxDB) EmitMultiple() {
-	if len(flxDB.metrics) == 0 {
+	if flxDB.spool == nil {
+		if len(flxDB.metrics) == 0 {
+			return
+		}
+		err := flxDB.write(flxDB.metrics)
+		if err != nil && !errors.Is(err, ErrWriteRejected) {
+			mylogger.MainLogger.Errorf("Error writing to InfluxDB: %s", err)
+			flxDB.dropOverflow()
+			return
+		}
+		flxDB.dropRejected(err)
+		// Clear the accumulated metrics after successful sending
+		flxDB.metrics = flxDB.metrics[:0]
+		return
+	}
+
+	flxDB.collectSpoolMetrics()
+	// The spooled metrics are older, they have to be written first.
+	if flxDB.spool.Replay(flxDB.writeLineProtocol) {
+		err := flxDB.write(flxDB.metrics)
+		if err == nil || errors.Is(err, ErrWriteRejected) {
+			flxDB.dropRejected(err)
+			flxDB.metrics = flxDB.metrics[:0]
+			return
+		}
+		mylogger.MainLogger.Errorf("Error writing to InfluxDB: %s", err)
+	}
+
+	var lineProtocol bytes.Buffer
+	for _, point := range flxDB.metrics {
+		lineProtocol.WriteString(point.String())
+		lineProtocol.WriteByte('\n')
+	}
+	err := flxDB.spool.Append(lineProtocol.Bytes(), len(flxDB.metrics))
+	if err != nil {
+		mylogger.MainLogger.Errorf("Failed spooling InfluxDB metrics, keeping them in memory, error: %s", err)
+		flxDB.dropOverflow()
 		return
 	}
+	flxDB.metrics = flxDB.metrics[:0]
+}
+
+// write sends the points to InfluxDB in one request.
+func (flxDB *InfluxDB) write(points []*influxdb_client.Point) error {
+	if flxDB.client == nil {
+		var lineProtocol bytes.Buffer
+		for _, point := range points {
+			lineProtocol.WriteString(point.String())
+			lineProtocol.WriteByte('\n')
+		}
+		return flxDB.writeHTTP(lineProtocol.Bytes())
+	}
 	bp, err := influxdb_client.NewBatchPoints(influxdb_client.BatchPointsConfig{
 		Database:  flxDB.database,
 		Precision: "ns",
 	})
 	if err != nil {
-		fmt.Printf("Error creating batch points: %s\n", err)
-		return
+		return err
 	}
-	bp.AddPoints(flxDB.metrics)
+	bp.AddPoints(points)
 
 	// Send the batch of points to InfluxDB
-	err = flxDB.client.Write(bp)
+	return flxDB.client.Write(bp)
+}
+
+// writeHTTP sends points in the line protocol to the write endpoint.
+func (flxDB *InfluxDB) writeHTTP(lines []byte) error {
+	response, err := flxDB.httpClient.Post(flxDB.writeURL, "text/plain; charset=utf-8", bytes.NewReader(lines))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return checkInfluxWriteResponse(response)
+}
+
+// checkInfluxWriteResponse turns the unsuccessful responses of the InfluxDB write endpoints into errors. The malformed,
+// conflicting or too large batches are rejections. The other errors, invalid credentials or a database not created yet
+// included, are retried as they can be fixed on the server side.
+func checkInfluxWriteResponse(response *http.Response) error {
+	if response.StatusCode == http.StatusNoContent || response.StatusCode == http.StatusOK {
+		return nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	err := fmt.Errorf("write failed with status: %s, %s", response.Status, bytes.TrimSpace(message))
+	switch response.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return writeRejected(err)
+	}
+	return err
+}
+
+// writeLineProtocol sends points stored in the line protocol, as they are spooled, to InfluxDB.
+func (flxDB *InfluxDB) writeLineProtocol(data []byte) error {
+	if flxDB.client == nil {
+		return flxDB.writeHTTP(data)
+	}
+	parsed, err := models.ParsePoints(data)
 	if err != nil {
-		fmt.Printf("Error writing to InfluxDB: %s\n", err)
+		// A corrupted segment can never be written, it must not block the spool.
+		mylogger.MainLogger.Errorf("Dropping unparsable spooled InfluxDB points, error: %s", err)
+		return nil
+	}
+	points := make([]*influxdb_client.Point, 0, len(parsed))
+	for _, point := range parsed {
+		points = append(points, influxdb_client.NewPointFrom(point))
+	}
+	return flxDB.write(points)
+}
+
+// collectSpoolMetrics adds the spool's own metrics to the accumulated metrics.
+func (flxDB *InfluxDB) collectSpoolMetrics() {
+	tags := map[string]string{"backend": "influxdb"}
+	flxDB.CollectMetrics(CreateSingleMetric("spool_depth", float64(flxDB.spool.Depth()), nil, tags))
+	flxDB.CollectMetrics(CreateSingleMetric("spool_dropped_points", float64(flxDB.spool.Dropped()+flxDB.dropped), nil, tags))
+}
+
+// dropOverflow drops the oldest accumulated metrics past INFLUXDB_MAX_PENDING_POINTS.
+func (flxDB *InfluxDB) dropOverflow() {
+	overflow := len(flxDB.metrics) - INFLUXDB_MAX_PENDING_POINTS
+	if overflow <= 0 {
 		return
 	}
+	mylogger.MainLogger.Errorf("Too many pending InfluxDB metrics, dropping the %d oldest", overflow)
+	flxDB.dropped += int64(overflow)
+	flxDB.metrics = append(flxDB.metrics[:0], flxDB.metrics[overflow:]...)
+}
 
-	// Clear the accumulated metrics after successful sending
+// dropRejected drops the accumulated metrics InfluxDB rejected, they would be rejected again on every retry.
+func (flxDB *InfluxDB) dropRejected(err error) {
+	if err == nil {
+		return
+	}
+	mylogger.MainLogger.Errorf("InfluxDB rejected %d metrics, dropping them, error: %s", len(flxDB.metrics), err)
+	flxDB.dropped += int64(len(flxDB.metrics))
 	flxDB.metrics = flxDB.metrics[:0]
 }
+
+// Close closes the underlying InfluxDB client.
+func (flxDB *InfluxDB) Close() error {
+	if flxDB.client == nil {
+		flxDB.httpClient.CloseIdleConnections()
+		return nil
+	}
+	return flxDB.client.Close()
+}
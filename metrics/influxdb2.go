@@ -0,0 +1,209 @@
+package metrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"inspector/config"
+	"inspector/mylogger"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/*
+ * Implementation of the InfluxDB 2.x metrics backend. Metrics are written in the line protocol over http(s) to the
+ * /api/v2/write endpoint, authenticated with an API token and optionally compressed with gzip.
+ * It spools the metrics to disk the same way the InfluxDB 1.x backend does.
+ */
+
+var INFLUXDB2_WRITE_TIMEOUT = 30 * time.Second
+
+type InfluxDB2 struct {
+	client       *http.Client
+	writeURL     string
+	protocol     string
+	organization string
+	token        string
+	gzip         bool
+	lines        bytes.Buffer
+	points       int
+	spoolConfig  *config.SpoolSubConfig
+	spool        *Spool
+	dropped      int64
+}
+
+// InitializeClient prepares the http client and the write url. The database is the bucket metrics are written to.
+func (flxDB *InfluxDB2) InitializeClient(addr string, port int, database string) error {
+	scheme := flxDB.protocol
+	switch scheme {
+	case "":
+		scheme = "https"
+	case "http", "https":
+	default:
+		return fmt.Errorf("unsupported InfluxDB 2.x transport protocol: %s", flxDB.protocol)
+	}
+	query := url.Values{}
+	query.Set("org", flxDB.organization)
+	query.Set("bucket", database)
+	query.Set("precision", "ns")
+	writeURL := url.URL{
+		Scheme:   scheme,
+		Host:     net.JoinHostPort(addr, strconv.Itoa(port)),
+		Path:     "/api/v2/write",
+		RawQuery: query.Encode(),
+	}
+	flxDB.writeURL = writeURL.String()
+	flxDB.client = &http.Client{Timeout: INFLUXDB2_WRITE_TIMEOUT}
+
+	if flxDB.spoolConfig != nil {
+		var err error
+		flxDB.spool, err = OpenSpool(*flxDB.spoolConfig)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EmitSingle sends a single metric out right away.
+func (flxDB *InfluxDB2) EmitSingle(m SingleMetric) {
+	point, err := newInfluxPoint(m)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Error creating point: %s", err)
+		return
+	}
+	err = flxDB.write([]byte(point.String() + "\n"))
+	if err != nil {
+		mylogger.MainLogger.Errorf("Error writing to InfluxDB 2.x: %s", err)
+	}
+}
+
+// CollectMetrics accumulates metrics in the line protocol for subsequent sending.
+func (flxDB *InfluxDB2) CollectMetrics(m SingleMetric) {
+	point, err := newInfluxPoint(m)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Error creating point: %s", err)
+		return
+	}
+	flxDB.lines.WriteString(point.String())
+	flxDB.lines.WriteByte('\n')
+	flxDB.points++
+}
+
+// EmitMultiple sends all accumulated metrics to InfluxDB in one request.
+// When a spool is configured, metrics which cannot be written are spooled to disk and replayed in order once InfluxDB
+// is reachable again. Otherwise they are kept in memory, up to INFLUXDB_MAX_PENDING_POINTS. Rejected metrics are dropped.
+func (flxDB *InfluxDB2) EmitMultiple() {
+	if flxDB.spool == nil {
+		if flxDB.points == 0 {
+			return
+		}
+		err := flxDB.write(flxDB.lines.Bytes())
+		if err != nil && !errors.Is(err, ErrWriteRejected) {
+			mylogger.MainLogger.Errorf("Error writing to InfluxDB 2.x: %s", err)
+			flxDB.dropOverflow()
+			return
+		}
+		flxDB.dropRejected(err)
+		flxDB.reset()
+		return
+	}
+
+	tags := map[string]string{"backend": "influxdb2"}
+	flxDB.CollectMetrics(CreateSingleMetric("spool_depth", float64(flxDB.spool.Depth()), nil, tags))
+	flxDB.CollectMetrics(CreateSingleMetric("spool_dropped_points", float64(flxDB.spool.Dropped()+flxDB.dropped), nil, tags))
+
+	// The spooled metrics are older, they have to be written first.
+	if flxDB.spool.Replay(flxDB.write) {
+		err := flxDB.write(flxDB.lines.Bytes())
+		if err == nil || errors.Is(err, ErrWriteRejected) {
+			flxDB.dropRejected(err)
+			flxDB.reset()
+			return
+		}
+		mylogger.MainLogger.Errorf("Error writing to InfluxDB 2.x: %s", err)
+	}
+	err := flxDB.spool.Append(flxDB.lines.Bytes(), flxDB.points)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Failed spooling InfluxDB 2.x metrics, keeping them in memory, error: %s", err)
+		flxDB.dropOverflow()
+		return
+	}
+	flxDB.reset()
+}
+
+// Close releases the idle connections.
+func (flxDB *InfluxDB2) Close() error {
+	flxDB.client.CloseIdleConnections()
+	return nil
+}
+
+// write sends metrics in the line protocol to InfluxDB in one request.
+func (flxDB *InfluxDB2) write(lines []byte) error {
+	body := lines
+	if flxDB.gzip {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		_, err := writer.Write(lines)
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			return err
+		}
+		body = compressed.Bytes()
+	}
+
+	request, err := http.NewRequest(http.MethodPost, flxDB.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Token "+flxDB.token)
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if flxDB.gzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+
+	response, err := flxDB.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return checkInfluxWriteResponse(response)
+}
+
+// dropRejected counts the accumulated metrics InfluxDB rejected as dropped, they would be rejected again on every retry.
+func (flxDB *InfluxDB2) dropRejected(err error) {
+	if err == nil {
+		return
+	}
+	mylogger.MainLogger.Errorf("InfluxDB 2.x rejected %d metrics, dropping them, error: %s", flxDB.points, err)
+	flxDB.dropped += int64(flxDB.points)
+}
+
+func (flxDB *InfluxDB2) reset() {
+	flxDB.lines.Reset()
+	flxDB.points = 0
+}
+
+// dropOverflow drops the oldest accumulated metrics past INFLUXDB_MAX_PENDING_POINTS.
+func (flxDB *InfluxDB2) dropOverflow() {
+	overflow := flxDB.points - INFLUXDB_MAX_PENDING_POINTS
+	if overflow <= 0 {
+		return
+	}
+	mylogger.MainLogger.Errorf("Too many pending InfluxDB 2.x metrics, dropping the %d oldest", overflow)
+	lines := flxDB.lines.Bytes()
+	for i := 0; i < overflow; i++ {
+		lines = lines[bytes.IndexByte(lines, '\n')+1:]
+	}
+	remaining := append([]byte(nil), lines...)
+	flxDB.lines.Reset()
+	flxDB.lines.Write(remaining)
+	flxDB.points -= overflow
+	flxDB.dropped += int64(overflow)
+}
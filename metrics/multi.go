@@ -0,0 +1,295 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"inspector/config"
+	"inspector/mylogger"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Implementation of a composite metrics database, forwarding the metrics to every configured backend.
+ * Every backend is fed by its own goroutine through its own buffer, so a slow or failing backend neither blocks nor
+ * drops data for the others. When the buffer of a backend is full, new metrics are dropped for that backend only.
+ */
+
+// METRICS_BACKEND_BUFFER_SIZE is the number of metrics buffered per backend.
+var METRICS_BACKEND_BUFFER_SIZE = 10000
+
+// METRICS_BACKEND_CLOSE_TIMEOUT bounds how long closing a backend may take, buffered metrics are flushed on close.
+var METRICS_BACKEND_CLOSE_TIMEOUT = 10 * time.Second
+
+type bufferedBackend struct {
+	name    string
+	config  config.MetricsDBSubConfig
+	db      MetricsDB
+	metrics chan SingleMetric
+	emit    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+type MultiMetricsDB struct {
+	// Serializes the reloads, which initialize and close backends without holding lock.
+	reloadLock sync.Mutex
+	lock       sync.RWMutex
+	backends   []*bufferedBackend
+	// Configs of the backends which could not be initialized, they are retried on every reload.
+	failed []config.MetricsDBSubConfig
+}
+
+// NewMultiMetricsDB initializes every metrics database in the config. Backends failing to initialize are skipped and
+// retried on the next reload, an error is only returned when none could be initialized.
+func NewMultiMetricsDB(configs []config.MetricsDBSubConfig) (*MultiMetricsDB, error) {
+	backends, failed, _ := newBufferedBackends(configs)
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("none of the %d configured metrics databases could be initialized", len(configs))
+	}
+	return &MultiMetricsDB{backends: backends, failed: failed}, nil
+}
+
+// Reload reconciles the backends with the config. Backends whose settings did not change are kept as they are, with
+// their connections and buffered metrics. The new or modified ones are initialized before the others are closed, as
+// well as the ones which previously failed to initialize.
+// The config is applied even when some backends fail to initialize, they are skipped, reported in the returned error
+// and by FailedBackends, and retried on the next reload. When the replaced backends hold a resource a new one needs,
+// like a listening port, the new one is retried once they are closed. Backends are initialized and closed without
+// holding the lock, metrics keep flowing meanwhile.
+func (multiDB *MultiMetricsDB) Reload(configs []config.MetricsDBSubConfig) error {
+	multiDB.reloadLock.Lock()
+	defer multiDB.reloadLock.Unlock()
+
+	multiDB.lock.RLock()
+	removed := append([]*bufferedBackend(nil), multiDB.backends...)
+	multiDB.lock.RUnlock()
+	var kept []*bufferedBackend
+	var added []config.MetricsDBSubConfig
+	for _, c := range configs {
+		found := false
+		for i, backend := range removed {
+			if reflect.DeepEqual(backend.config, c) {
+				kept = append(kept, backend)
+				removed = append(removed[:i], removed[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			added = append(added, c)
+		}
+	}
+
+	created, failed, err := newBufferedBackends(added)
+	if len(failed) > 0 && len(removed) > 0 {
+		multiDB.swap(append(kept, created...), failed)
+		closeBackends(removed)
+		removed = nil
+		var retried []*bufferedBackend
+		retried, failed, err = newBufferedBackends(failed)
+		created = append(created, retried...)
+	}
+	multiDB.swap(append(kept, created...), failed)
+	closeBackends(removed)
+	return err
+}
+
+// FailedBackends returns the names of the configured backends which could not be initialized.
+func (multiDB *MultiMetricsDB) FailedBackends() []string {
+	multiDB.lock.RLock()
+	defer multiDB.lock.RUnlock()
+	names := make([]string, 0, len(multiDB.failed))
+	for _, c := range multiDB.failed {
+		names = append(names, metricsDBName(c))
+	}
+	return names
+}
+
+// swap replaces the backends the metrics are forwarded to, and the configs of the ones which failed.
+func (multiDB *MultiMetricsDB) swap(backends []*bufferedBackend, failed []config.MetricsDBSubConfig) {
+	multiDB.lock.Lock()
+	defer multiDB.lock.Unlock()
+	multiDB.backends = backends
+	multiDB.failed = failed
+}
+
+// InitializeClient does nothing, the backends are initialized by NewMultiMetricsDB.
+func (multiDB *MultiMetricsDB) InitializeClient(addr string, port int, database string) error {
+	return nil
+}
+
+// EmitSingle forwards the metric to every backend and asks them to send out everything they accumulated.
+func (multiDB *MultiMetricsDB) EmitSingle(m SingleMetric) {
+	multiDB.CollectMetrics(m)
+	multiDB.EmitMultiple()
+}
+
+// CollectMetrics forwards the metric to the buffer of every backend.
+func (multiDB *MultiMetricsDB) CollectMetrics(m SingleMetric) {
+	multiDB.lock.RLock()
+	defer multiDB.lock.RUnlock()
+	for _, backend := range multiDB.backends {
+		// Backends modify the metric's maps, every backend gets its own copy.
+		select {
+		case backend.metrics <- copyMetric(m):
+		default:
+			backend.dropped.Add(1)
+		}
+	}
+}
+
+// EmitMultiple asks every backend to send out the metrics it accumulated.
+func (multiDB *MultiMetricsDB) EmitMultiple() {
+	multiDB.lock.RLock()
+	defer multiDB.lock.RUnlock()
+	for _, backend := range multiDB.backends {
+		if dropped := backend.dropped.Swap(0); dropped > 0 {
+			mylogger.MainLogger.Errorf("Metrics db: %s is falling behind, dropped %d metrics", backend.name, dropped)
+		}
+		// A pending emit request covers this one as well.
+		select {
+		case backend.emit <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close flushes and closes every backend.
+func (multiDB *MultiMetricsDB) Close() error {
+	multiDB.reloadLock.Lock()
+	defer multiDB.reloadLock.Unlock()
+	multiDB.lock.Lock()
+	backends := multiDB.backends
+	multiDB.backends = nil
+	multiDB.failed = nil
+	multiDB.lock.Unlock()
+	for _, backend := range backends {
+		backend.close()
+	}
+	return nil
+}
+
+// newBufferedBackends initializes the backends of the configs. It returns the initialized backends, and the configs of
+// the ones which failed along with their errors.
+func newBufferedBackends(configs []config.MetricsDBSubConfig) ([]*bufferedBackend, []config.MetricsDBSubConfig, error) {
+	var backends []*bufferedBackend
+	var failed []config.MetricsDBSubConfig
+	var errs []error
+	for _, c := range configs {
+		backend, err := newBufferedBackend(c)
+		if err != nil {
+			mylogger.MainLogger.Errorf("Failed initializing metrics db: %s, error: %s", metricsDBName(c), err)
+			failed = append(failed, c)
+			errs = append(errs, fmt.Errorf("metrics db %s: %w", metricsDBName(c), err))
+			continue
+		}
+		backends = append(backends, backend)
+	}
+	return backends, failed, errors.Join(errs...)
+}
+
+// closeBackends closes the backends one after the other.
+func closeBackends(backends []*bufferedBackend) {
+	for _, backend := range backends {
+		mylogger.MainLogger.Infof("Closing metrics db: %s", backend.name)
+		backend.close()
+	}
+}
+
+func newBufferedBackend(c config.MetricsDBSubConfig) (*bufferedBackend, error) {
+	db, err := NewMetricsDB(c)
+	if err != nil {
+		return nil, err
+	}
+	backend := &bufferedBackend{
+		name:    metricsDBName(c),
+		config:  c,
+		db:      db,
+		metrics: make(chan SingleMetric, METRICS_BACKEND_BUFFER_SIZE),
+		emit:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go backend.loop()
+	return backend, nil
+}
+
+// loop is the only place the backend's client is used from, clients are not expected to be goroutine safe.
+func (backend *bufferedBackend) loop() {
+	defer close(backend.done)
+	for {
+		select {
+		case m := <-backend.metrics:
+			backend.db.CollectMetrics(m)
+		case <-backend.emit:
+			backend.db.EmitMultiple()
+		case <-backend.stop:
+			for {
+				select {
+				case m := <-backend.metrics:
+					backend.db.CollectMetrics(m)
+				default:
+					backend.db.EmitMultiple()
+					err := backend.db.Close()
+					if err != nil {
+						mylogger.MainLogger.Errorf("Failed closing metrics db: %s, error: %s", backend.name, err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// close stops the backend, waiting at most METRICS_BACKEND_CLOSE_TIMEOUT for the buffered metrics to be flushed.
+func (backend *bufferedBackend) close() {
+	close(backend.stop)
+	select {
+	case <-backend.done:
+	case <-time.After(METRICS_BACKEND_CLOSE_TIMEOUT):
+		mylogger.MainLogger.Errorf("Timed out closing metrics db: %s", backend.name)
+	}
+}
+
+func copyMetric(m SingleMetric) SingleMetric {
+	if m.Tags != nil {
+		tags := make(map[string]string, len(m.Tags))
+		for key, value := range m.Tags {
+			tags[key] = value
+		}
+		m.Tags = tags
+	}
+	if m.AdditionalFields != nil {
+		fields := make(map[string]interface{}, len(m.AdditionalFields))
+		for key, value := range m.AdditionalFields {
+			fields[key] = value
+		}
+		m.AdditionalFields = fields
+	}
+	return m
+}
+
+// metricsDBName names the type of the metrics database in the config, for logging.
+func metricsDBName(c config.MetricsDBSubConfig) string {
+	switch {
+	case c.InfluxDBSubConfig != nil:
+		return fmt.Sprintf("influxdb %s:%d", c.InfluxDBSubConfig.DatabaseURL, c.InfluxDBSubConfig.Port)
+	case c.InfluxDB2SubConfig != nil:
+		return fmt.Sprintf("influxdb2 %s:%d", c.InfluxDB2SubConfig.DatabaseURL, c.InfluxDB2SubConfig.Port)
+	case c.MySQLDBSubConfig != nil:
+		return fmt.Sprintf("mysqldb %s:%d", c.MySQLDBSubConfig.DatabaseURL, c.MySQLDBSubConfig.Port)
+	case c.PrometheusSubConfig != nil:
+		return fmt.Sprintf("prometheus %s:%d", c.PrometheusSubConfig.ListenAddress, c.PrometheusSubConfig.Port)
+	case c.OTLPSubConfig != nil:
+		return fmt.Sprintf("otlp %s:%d", c.OTLPSubConfig.CollectorURL, c.OTLPSubConfig.Port)
+	case c.StatsDSubConfig != nil:
+		return fmt.Sprintf("statsd %s:%d", c.StatsDSubConfig.Address, c.StatsDSubConfig.Port)
+	case c.GraphiteSubConfig != nil:
+		return fmt.Sprintf("graphite %s:%d", c.GraphiteSubConfig.Address, c.GraphiteSubConfig.Port)
+	}
+	return "unknown"
+}
@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"inspector/mylogger"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+/*
+ * Implementation of a MySQL metrics backend, for the setups without a time series database.
+ * The metrics table is created on initialization when it does not exist. Every metric is a row holding its name,
+ * value, tags and additional fields (as json) and the timestamp. Metrics older than the configured retention are
+ * pruned at most once per MYSQL_PRUNE_INTERVAL.
+ */
+
+var MYSQL_METRICS_TABLE = "metrics"
+
+// MYSQL_INSERT_BATCH_SIZE is the maximum number of rows inserted by a single statement.
+var MYSQL_INSERT_BATCH_SIZE = 500
+
+var MYSQL_PRUNE_INTERVAL = time.Hour
+
+// MYSQL_MAX_PENDING_ROWS caps the metrics kept in memory while MySQL is unreachable, the oldest are dropped past it.
+var MYSQL_MAX_PENDING_ROWS = 100000
+
+type mysqlRow struct {
+	name      string
+	value     float64
+	tags      []byte
+	fields    []byte
+	timestamp time.Time
+}
+
+type MySQLDB struct {
+	db        *sql.DB
+	username  string
+	password  string
+	database  string
+	retention time.Duration
+	lastPrune time.Time
+	metrics   []mysqlRow
+}
+
+// InitializeClient opens the connection pool and creates the metrics table if needed.
+func (myDB *MySQLDB) InitializeClient(addr string, port int, database string) error {
+	dsnConfig := mysql.NewConfig()
+	dsnConfig.User = myDB.username
+	dsnConfig.Passwd = myDB.password
+	dsnConfig.Net = "tcp"
+	dsnConfig.Addr = net.JoinHostPort(addr, strconv.Itoa(port))
+	dsnConfig.DBName = database
+	dsnConfig.ParseTime = true
+	dsnConfig.Loc = time.UTC
+
+	var err error
+	myDB.db, err = sql.Open("mysql", dsnConfig.FormatDSN())
+	if err != nil {
+		return err
+	}
+	myDB.database = database
+	myDB.metrics = make([]mysqlRow, 0)
+
+	_, err = myDB.db.Exec(`CREATE TABLE IF NOT EXISTS ` + MYSQL_METRICS_TABLE + ` (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		value DOUBLE NOT NULL,
+		tags JSON,
+		fields JSON,
+		timestamp DATETIME(6) NOT NULL,
+		INDEX idx_name_timestamp (name, timestamp),
+		INDEX idx_timestamp (timestamp)
+	)`)
+	if err != nil {
+		myDB.db.Close()
+		return fmt.Errorf("failed creating the metrics table: %w", err)
+	}
+	return nil
+}
+
+// EmitSingle inserts a single metric right away.
+func (myDB *MySQLDB) EmitSingle(m SingleMetric) {
+	row, err := newMySQLRow(m)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Error creating row: %s", err)
+		return
+	}
+	err = myDB.insert([]mysqlRow{row})
+	if err != nil {
+		mylogger.MainLogger.Errorf("Error writing to MySQL: %s", err)
+	}
+}
+
+// CollectMetrics accumulates metrics for subsequent sending.
+func (myDB *MySQLDB) CollectMetrics(m SingleMetric) {
+	row, err := newMySQLRow(m)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Error creating row: %s", err)
+		return
+	}
+	myDB.metrics = append(myDB.metrics, row)
+}
+
+// EmitMultiple inserts all accumulated metrics in batches. They are kept in memory while MySQL is unreachable, up to
+// MYSQL_MAX_PENDING_ROWS, and prunes the metrics past the retention.
+func (myDB *MySQLDB) EmitMultiple() {
+	for len(myDB.metrics) > 0 {
+		batch := myDB.metrics[:min(len(myDB.metrics), MYSQL_INSERT_BATCH_SIZE)]
+		err := myDB.insert(batch)
+		if err != nil {
+			mylogger.MainLogger.Errorf("Error writing to MySQL: %s", err)
+			myDB.dropOverflow()
+			return
+		}
+		myDB.metrics = myDB.metrics[len(batch):]
+	}
+	// Clear the accumulated metrics after successful sending
+	myDB.metrics = make([]mysqlRow, 0)
+
+	if myDB.retention > 0 && time.Since(myDB.lastPrune) > MYSQL_PRUNE_INTERVAL {
+		result, err := myDB.db.Exec(`DELETE FROM `+MYSQL_METRICS_TABLE+` WHERE timestamp < ?`,
+			time.Now().Add(-myDB.retention).UTC())
+		if err != nil {
+			mylogger.MainLogger.Errorf("Error pruning MySQL metrics: %s", err)
+			return
+		}
+		pruned, _ := result.RowsAffected()
+		mylogger.MainLogger.Infof("Pruned %d metrics older than %s from MySQL", pruned, myDB.retention)
+		myDB.lastPrune = time.Now()
+	}
+}
+
+// dropOverflow drops the oldest accumulated metrics past MYSQL_MAX_PENDING_ROWS.
+func (myDB *MySQLDB) dropOverflow() {
+	overflow := len(myDB.metrics) - MYSQL_MAX_PENDING_ROWS
+	if overflow <= 0 {
+		return
+	}
+	mylogger.MainLogger.Errorf("Too many pending MySQL metrics, dropping the %d oldest", overflow)
+	myDB.metrics = append(myDB.metrics[:0], myDB.metrics[overflow:]...)
+}
+
+// Close closes the connection pool.
+func (myDB *MySQLDB) Close() error {
+	return myDB.db.Close()
+}
+
+func (myDB *MySQLDB) insert(rows []mysqlRow) error {
+	placeholders := make([]string, 0, len(rows))
+	args := make([]interface{}, 0, 5*len(rows))
+	for _, row := range rows {
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?)")
+		args = append(args, row.name, row.value, row.tags, row.fields, row.timestamp)
+	}
+	_, err := myDB.db.Exec(`INSERT INTO `+MYSQL_METRICS_TABLE+` (name, value, tags, fields, timestamp) VALUES `+
+		strings.Join(placeholders, ", "), args...)
+	return err
+}
+
+// newMySQLRow converts the metric into a row. It adds the source host where the metric is coming from.
+func newMySQLRow(m SingleMetric) (mysqlRow, error) {
+	if m.Tags == nil {
+		m.Tags = make(map[string]string)
+	}
+	if _, ok := m.Tags["host"]; !ok {
+		m.Tags["host"], _ = os.Hostname()
+	}
+	tags, err := json.Marshal(m.Tags)
+	if err != nil {
+		return mysqlRow{}, err
+	}
+	var fields []byte
+	if m.AdditionalFields != nil {
+		fields, err = json.Marshal(m.AdditionalFields)
+		if err != nil {
+			return mysqlRow{}, err
+		}
+	}
+	return mysqlRow{
+		name:      m.Name,
+		value:     m.Value,
+		tags:      tags,
+		fields:    fields,
+		timestamp: m.measuredAt().UTC(),
+	}, nil
+}
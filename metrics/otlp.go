@@ -0,0 +1,249 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"inspector/mylogger"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+/*
+ * Implementation of an OpenTelemetry metrics backend, exporting to a collector over OTLP (grpc or http/protobuf).
+ * Every metric is exported as a data point of a gauge of the same name, latency metrics (the ones named *_time) are
+ * additionally aggregated on a <name>_histogram delta histogram. Tags become attributes, except for the region and
+ * host tags which describe the inspector instance and become the cloud.region and host.name resource attributes.
+ * The metric data is built here and handed to the exporter directly rather than recorded through the sdk instruments,
+ * which timestamp the data points on export, so every data point carries the time its metric was measured at.
+ */
+
+var OTLP_SERVICE_NAME = "inspector"
+var OTLP_EXPORT_TIMEOUT = 30 * time.Second
+
+// OTLP_HISTOGRAM_BUCKETS are the upper bounds of the latency histogram buckets, in milliseconds.
+var OTLP_HISTOGRAM_BUCKETS = []float64{0, 5, 10, 25, 50, 75, 100, 250, 500, 750, 1000, 2500, 5000, 7500, 10000}
+
+// otlpResource accumulates the data points of a distinct region and host until they are exported.
+type otlpResource struct {
+	resource   *resource.Resource
+	gauges     map[string][]metricdata.DataPoint[float64]
+	histograms map[string]map[attribute.Distinct]*metricdata.HistogramDataPoint[float64]
+}
+
+type OTLP struct {
+	endpoint  string
+	protocol  string
+	urlPath   string
+	insecure  bool
+	headers   map[string]string
+	gzip      bool
+	exporter  sdkmetric.Exporter
+	resources map[string]*otlpResource
+}
+
+// InitializeClient creates the exporter. The database argument is not used.
+func (otlp *OTLP) InitializeClient(addr string, port int, database string) error {
+	switch otlp.protocol {
+	case "":
+		otlp.protocol = "grpc"
+	case "grpc", "http":
+	default:
+		return fmt.Errorf("unsupported OTLP transport protocol: %s", otlp.protocol)
+	}
+	otlp.endpoint = net.JoinHostPort(addr, strconv.Itoa(port))
+	otlp.resources = make(map[string]*otlpResource)
+	var err error
+	otlp.exporter, err = otlp.newExporter()
+	return err
+}
+
+// EmitSingle records a single metric and exports it right away.
+func (otlp *OTLP) EmitSingle(m SingleMetric) {
+	otlp.CollectMetrics(m)
+	otlp.EmitMultiple()
+}
+
+// CollectMetrics adds the metric as a data point of the resource of its region and host, until the next export.
+func (otlp *OTLP) CollectMetrics(m SingleMetric) {
+	region := m.Tags["region"]
+	host, ok := m.Tags["host"]
+	if !ok {
+		host, _ = os.Hostname()
+	}
+	attributes := make([]attribute.KeyValue, 0, len(m.Tags))
+	for key, value := range m.Tags {
+		if key == "region" || key == "host" {
+			continue
+		}
+		attributes = append(attributes, attribute.String(key, value))
+	}
+	set := attribute.NewSet(attributes...)
+	measuredAt := m.measuredAt()
+
+	pending := otlp.resource(region, host)
+	pending.gauges[m.Name] = append(pending.gauges[m.Name], metricdata.DataPoint[float64]{
+		Attributes: set,
+		Time:       measuredAt,
+		Value:      m.Value,
+	})
+	if !strings.HasSuffix(m.Name, "_time") {
+		return
+	}
+	points, ok := pending.histograms[m.Name]
+	if !ok {
+		points = make(map[attribute.Distinct]*metricdata.HistogramDataPoint[float64])
+		pending.histograms[m.Name] = points
+	}
+	point, ok := points[set.Equivalent()]
+	if !ok {
+		point = &metricdata.HistogramDataPoint[float64]{
+			Attributes:   set,
+			StartTime:    measuredAt,
+			Time:         measuredAt,
+			Bounds:       OTLP_HISTOGRAM_BUCKETS,
+			BucketCounts: make([]uint64, len(OTLP_HISTOGRAM_BUCKETS)+1),
+			Min:          metricdata.NewExtrema(m.Value),
+			Max:          metricdata.NewExtrema(m.Value),
+		}
+		points[set.Equivalent()] = point
+	}
+	// The data point covers the measurements from the oldest to the newest, whatever order they arrived in.
+	if measuredAt.Before(point.StartTime) {
+		point.StartTime = measuredAt
+	}
+	if measuredAt.After(point.Time) {
+		point.Time = measuredAt
+	}
+	if minimum, _ := point.Min.Value(); m.Value < minimum {
+		point.Min = metricdata.NewExtrema(m.Value)
+	}
+	if maximum, _ := point.Max.Value(); m.Value > maximum {
+		point.Max = metricdata.NewExtrema(m.Value)
+	}
+	point.Count++
+	point.Sum += m.Value
+	point.BucketCounts[sort.SearchFloat64s(OTLP_HISTOGRAM_BUCKETS, m.Value)]++
+}
+
+// EmitMultiple exports the data points collected so far, one request per resource. Data points failing to export are
+// dropped, the exporter retries transient failures itself.
+func (otlp *OTLP) EmitMultiple() {
+	for key, pending := range otlp.resources {
+		ctx, cancel := context.WithTimeout(context.Background(), OTLP_EXPORT_TIMEOUT)
+		err := otlp.exporter.Export(ctx, pending.resourceMetrics())
+		cancel()
+		if err != nil {
+			mylogger.MainLogger.Errorf("Error exporting to OTLP collector: %s", err)
+		}
+		delete(otlp.resources, key)
+	}
+}
+
+// Close exports the pending metrics and shuts the exporter down.
+func (otlp *OTLP) Close() error {
+	otlp.EmitMultiple()
+	ctx, cancel := context.WithTimeout(context.Background(), OTLP_EXPORT_TIMEOUT)
+	defer cancel()
+	return otlp.exporter.Shutdown(ctx)
+}
+
+// resource returns the pending data points of the resource, creating them on first use.
+func (otlp *OTLP) resource(region, host string) *otlpResource {
+	key := region + "|" + host
+	if pending, ok := otlp.resources[key]; ok {
+		return pending
+	}
+	attributes := []attribute.KeyValue{
+		attribute.String("service.name", OTLP_SERVICE_NAME),
+		attribute.String("host.name", host),
+	}
+	if region != "" {
+		attributes = append(attributes, attribute.String("cloud.region", region))
+	}
+	pending := &otlpResource{
+		resource:   resource.NewSchemaless(attributes...),
+		gauges:     make(map[string][]metricdata.DataPoint[float64]),
+		histograms: make(map[string]map[attribute.Distinct]*metricdata.HistogramDataPoint[float64]),
+	}
+	otlp.resources[key] = pending
+	return pending
+}
+
+// resourceMetrics builds the metric data of the pending data points, the metrics sorted by name.
+func (pending *otlpResource) resourceMetrics() *metricdata.ResourceMetrics {
+	names := make([]string, 0, len(pending.gauges))
+	for name := range pending.gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	exported := make([]metricdata.Metrics, 0, len(names)+len(pending.histograms))
+	for _, name := range names {
+		exported = append(exported, metricdata.Metrics{
+			Name: name,
+			Data: metricdata.Gauge[float64]{DataPoints: pending.gauges[name]},
+		})
+		points, ok := pending.histograms[name]
+		if !ok {
+			continue
+		}
+		histogram := metricdata.Histogram[float64]{Temporality: metricdata.DeltaTemporality}
+		for _, point := range points {
+			histogram.DataPoints = append(histogram.DataPoints, *point)
+		}
+		exported = append(exported, metricdata.Metrics{Name: name + "_histogram", Unit: "ms", Data: histogram})
+	}
+	return &metricdata.ResourceMetrics{
+		Resource: pending.resource,
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope:   instrumentation.Scope{Name: OTLP_SERVICE_NAME},
+			Metrics: exported,
+		}},
+	}
+}
+
+func (otlp *OTLP) newExporter() (sdkmetric.Exporter, error) {
+	ctx := context.Background()
+	if otlp.protocol == "http" {
+		options := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(otlp.endpoint),
+			otlpmetrichttp.WithHeaders(otlp.headers),
+			otlpmetrichttp.WithTimeout(OTLP_EXPORT_TIMEOUT),
+		}
+		if otlp.urlPath != "" {
+			options = append(options, otlpmetrichttp.WithURLPath(otlp.urlPath))
+		}
+		if otlp.insecure {
+			options = append(options, otlpmetrichttp.WithInsecure())
+		}
+		if otlp.gzip {
+			options = append(options, otlpmetrichttp.WithCompression(otlpmetrichttp.GzipCompression))
+		}
+		return otlpmetrichttp.New(ctx, options...)
+	}
+
+	options := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithEndpoint(otlp.endpoint),
+		otlpmetricgrpc.WithHeaders(otlp.headers),
+		otlpmetricgrpc.WithTimeout(OTLP_EXPORT_TIMEOUT),
+	}
+	if otlp.insecure {
+		options = append(options, otlpmetricgrpc.WithInsecure())
+	}
+	if otlp.gzip {
+		options = append(options, otlpmetricgrpc.WithCompressor("gzip"))
+	}
+	return otlpmetricgrpc.New(ctx, options...)
+}
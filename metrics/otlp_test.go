@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"inspector/mylogger"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	glogger "github.com/google/logger"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func init() {
+	if mylogger.MainLogger == nil {
+		mylogger.MainLogger = glogger.Init("InspectorTestLogger", false, false, io.Discard)
+	}
+}
+
+// otlpReceiver collects the export requests sent to an in-process OTLP/HTTP endpoint.
+type otlpReceiver struct {
+	lock     sync.Mutex
+	requests []*collectormetrics.ExportMetricsServiceRequest
+}
+
+func (receiver *otlpReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request := &collectormetrics.ExportMetricsServiceRequest{}
+	err = proto.Unmarshal(body, request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	receiver.lock.Lock()
+	receiver.requests = append(receiver.requests, request)
+	receiver.lock.Unlock()
+
+	response, _ := proto.Marshal(&collectormetrics.ExportMetricsServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(response)
+}
+
+func otlpAttributes(attributes []*commonv1.KeyValue) map[string]string {
+	values := make(map[string]string)
+	for _, attribute := range attributes {
+		values[attribute.Key] = attribute.Value.GetStringValue()
+	}
+	return values
+}
+
+func TestOTLPExportsResourceAndDataPointAttributes(t *testing.T) {
+	receiver := &otlpReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	host, portPart, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portPart)
+
+	otlp := &OTLP{protocol: "http", insecure: true}
+	err := otlp.InitializeClient(host, port, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := CreateSingleMetric("response_time", 12.5, nil, map[string]string{
+		"region":    "eu-west-1",
+		"host":      "inspector-1",
+		"target_id": "website",
+		"prober_id": "homepage",
+	})
+	// The data points must carry the time the metric was measured at, not the time it was exported at.
+	m.Timestamp = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	otlp.CollectMetrics(m)
+	otlp.EmitMultiple()
+	err = otlp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	if len(receiver.requests) == 0 {
+		t.Fatal("no export received")
+	}
+	resourceMetrics := receiver.requests[0].ResourceMetrics
+	if len(resourceMetrics) != 1 {
+		t.Fatalf("got %d resources, want 1", len(resourceMetrics))
+	}
+
+	resource := otlpAttributes(resourceMetrics[0].Resource.Attributes)
+	if resource["cloud.region"] != "eu-west-1" || resource["host.name"] != "inspector-1" {
+		t.Errorf("unexpected resource attributes: %v", resource)
+	}
+
+	found := make(map[string]bool)
+	for _, scopeMetrics := range resourceMetrics[0].ScopeMetrics {
+		for _, exported := range scopeMetrics.Metrics {
+			found[exported.Name] = true
+			if exported.Name == "response_time_histogram" {
+				points := exported.GetHistogram().GetDataPoints()
+				if len(points) != 1 || points[0].GetCount() != 1 || points[0].GetTimeUnixNano() != uint64(m.Timestamp.UnixNano()) {
+					t.Errorf("unexpected histogram data points: %v", points)
+				}
+				continue
+			}
+			if exported.Name != "response_time" {
+				continue
+			}
+			points := exported.GetGauge().GetDataPoints()
+			if len(points) != 1 {
+				t.Fatalf("got %d data points, want 1", len(points))
+			}
+			if points[0].GetAsDouble() != 12.5 {
+				t.Errorf("value = %v, want 12.5", points[0].GetAsDouble())
+			}
+			if points[0].GetTimeUnixNano() != uint64(m.Timestamp.UnixNano()) {
+				t.Errorf("time = %d, want %d", points[0].GetTimeUnixNano(), m.Timestamp.UnixNano())
+			}
+			attributes := otlpAttributes(points[0].Attributes)
+			if len(attributes) != 2 || attributes["target_id"] != "website" || attributes["prober_id"] != "homepage" {
+				t.Errorf("unexpected data point attributes: %v", attributes)
+			}
+		}
+	}
+	if !found["response_time"] || !found["response_time_histogram"] {
+		t.Errorf("missing exported metrics, got: %v", found)
+	}
+}
@@ -0,0 +1,298 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"inspector/mylogger"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Implementation of a Prometheus metrics backend. Prometheus pulls the metrics, so instead of pushing them out this
+ * backend keeps the latest value of every metric and tag set as a gauge, and serves them on an http listener in the
+ * Prometheus text exposition format.
+ * Latency metrics (the ones named *_time) are additionally aggregated in a <name>_histogram histogram.
+ * Metric names are prefixed with inspector_, tags become labels. Additional fields are not exported.
+ * The outcome labels of a failed probe (failed_assertion, failed_stage) are not part of the identity of a series: a new
+ * value replaces the series of the same metric and other labels, so the failed series goes away once the probe recovers.
+ */
+
+var PROMETHEUS_METRIC_PREFIX = "inspector_"
+
+// PROMETHEUS_SERIES_TTL drops the series which were not updated for this long, e.g. the ones of removed probers,
+// unless the config sets its own series ttl.
+var PROMETHEUS_SERIES_TTL = 15 * time.Minute
+
+// PROMETHEUS_DEFAULT_BUCKETS are the default upper bounds of the latency histogram buckets, in milliseconds.
+var PROMETHEUS_DEFAULT_BUCKETS = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+var invalidPrometheusNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+type prometheusGauge struct {
+	name     string
+	labels   string
+	identity string
+	value    float64
+	updated  time.Time
+}
+
+type prometheusHistogram struct {
+	name    string
+	labels  string
+	counts  []uint64
+	sum     float64
+	count   uint64
+	updated time.Time
+}
+
+type Prometheus struct {
+	path       string
+	buckets    []float64
+	seriesTTL  string
+	ttl        time.Duration
+	server     *http.Server
+	listener   net.Listener
+	lock       sync.Mutex
+	gauges     map[string]*prometheusGauge
+	histograms map[string]*prometheusHistogram
+	// Key of the current gauge of every series identity, the metric name and its labels but the outcome labels.
+	identities map[string]string
+}
+
+// InitializeClient starts the http listener serving the metrics. The database argument is not used.
+func (prom *Prometheus) InitializeClient(addr string, port int, database string) error {
+	if prom.path == "" {
+		prom.path = "/metrics"
+	}
+	if len(prom.buckets) == 0 {
+		prom.buckets = PROMETHEUS_DEFAULT_BUCKETS
+	}
+	prom.ttl = PROMETHEUS_SERIES_TTL
+	if prom.seriesTTL != "" {
+		var err error
+		prom.ttl, err = time.ParseDuration(prom.seriesTTL)
+		if err != nil {
+			return fmt.Errorf("invalid series ttl: %s, error: %w", prom.seriesTTL, err)
+		}
+		if prom.ttl <= 0 {
+			return fmt.Errorf("series ttl must be positive, got: %s", prom.seriesTTL)
+		}
+	}
+	prom.buckets = append([]float64(nil), prom.buckets...)
+	sort.Float64s(prom.buckets)
+	prom.gauges = make(map[string]*prometheusGauge)
+	prom.histograms = make(map[string]*prometheusHistogram)
+	prom.identities = make(map[string]string)
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	prom.listener = listener
+	mux := http.NewServeMux()
+	mux.HandleFunc(prom.path, prom.serveMetrics)
+	prom.server = &http.Server{Handler: mux}
+	go func() {
+		err := prom.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			mylogger.MainLogger.Errorf("Prometheus listener failed: %s", err)
+		}
+	}()
+	mylogger.MainLogger.Infof("Serving Prometheus metrics on %s%s", listener.Addr(), prom.path)
+	return nil
+}
+
+// EmitSingle records a single metric. Metrics are pulled by Prometheus, so there is nothing to send out.
+func (prom *Prometheus) EmitSingle(m SingleMetric) {
+	prom.CollectMetrics(m)
+}
+
+// CollectMetrics records the latest value of the metric, and adds latency metrics to their histogram.
+func (prom *Prometheus) CollectMetrics(m SingleMetric) {
+	if m.Tags == nil {
+		m.Tags = make(map[string]string)
+	}
+	if _, ok := m.Tags["host"]; !ok {
+		m.Tags["host"], _ = os.Hostname()
+	}
+	name := PROMETHEUS_METRIC_PREFIX + sanitizePrometheusName(m.Name)
+	labels := formatPrometheusLabels(m.Tags)
+	key := name + labels
+	value := m.Value
+	now := m.measuredAt()
+
+	prom.lock.Lock()
+	defer prom.lock.Unlock()
+
+	identity := name + formatPrometheusLabels(withoutOutcomeTags(m.Tags))
+	if previous, ok := prom.identities[identity]; ok && previous != key {
+		delete(prom.gauges, previous)
+	}
+	prom.identities[identity] = key
+	gauge, ok := prom.gauges[key]
+	if !ok {
+		gauge = &prometheusGauge{name: name, labels: labels, identity: identity}
+		prom.gauges[key] = gauge
+	}
+	gauge.value = value
+	gauge.updated = now
+
+	if !strings.HasSuffix(m.Name, "_time") {
+		return
+	}
+	histogramName := name + "_histogram"
+	histogram, ok := prom.histograms[histogramName+labels]
+	if !ok {
+		histogram = &prometheusHistogram{
+			name:   histogramName,
+			labels: labels,
+			counts: make([]uint64, len(prom.buckets)),
+		}
+		prom.histograms[histogramName+labels] = histogram
+	}
+	for i, bound := range prom.buckets {
+		if value <= bound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.sum += value
+	histogram.count++
+	histogram.updated = now
+}
+
+// EmitMultiple does nothing, the collected metrics are served on scrape.
+func (prom *Prometheus) EmitMultiple() {
+}
+
+// Close shuts the http listener down. The port is released by the time Close returns, so a new listener can bind it.
+func (prom *Prometheus) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := prom.server.Shutdown(ctx)
+	// Shutdown misses the listener when the server did not start serving yet.
+	prom.listener.Close()
+	return err
+}
+
+// serveMetrics writes all the series in the Prometheus text exposition format.
+func (prom *Prometheus) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	prom.lock.Lock()
+	defer prom.lock.Unlock()
+
+	for key, gauge := range prom.gauges {
+		if time.Since(gauge.updated) > prom.ttl {
+			delete(prom.gauges, key)
+			delete(prom.identities, gauge.identity)
+		}
+	}
+	for key, histogram := range prom.histograms {
+		if time.Since(histogram.updated) > prom.ttl {
+			delete(prom.histograms, key)
+		}
+	}
+
+	// Series of the same metric must be grouped together under a single TYPE line.
+	families := make(map[string][]string)
+	types := make(map[string]string)
+	for _, gauge := range prom.gauges {
+		families[gauge.name] = append(families[gauge.name],
+			fmt.Sprintf("%s%s %s", gauge.name, gauge.labels, formatPrometheusValue(gauge.value)))
+		types[gauge.name] = "gauge"
+	}
+	for _, histogram := range prom.histograms {
+		for i, bound := range prom.buckets {
+			families[histogram.name] = append(families[histogram.name], fmt.Sprintf("%s_bucket%s %d",
+				histogram.name, withPrometheusLabel(histogram.labels, "le", formatPrometheusValue(bound)),
+				histogram.counts[i]))
+		}
+		families[histogram.name] = append(families[histogram.name],
+			fmt.Sprintf("%s_bucket%s %d", histogram.name, withPrometheusLabel(histogram.labels, "le", "+Inf"),
+				histogram.count),
+			fmt.Sprintf("%s_sum%s %s", histogram.name, histogram.labels, formatPrometheusValue(histogram.sum)),
+			fmt.Sprintf("%s_count%s %d", histogram.name, histogram.labels, histogram.count))
+		types[histogram.name] = "histogram"
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, name := range names {
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, types[name])
+		lines := families[name]
+		// Histogram lines are already in order, only the gauges need sorting.
+		if types[name] == "gauge" {
+			sort.Strings(lines)
+		}
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+func sanitizePrometheusName(name string) string {
+	name = invalidPrometheusNameChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// formatPrometheusLabels formats the tags as a label set, sorted by label name.
+func formatPrometheusLabels(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	labels := make([]string, 0, len(names))
+	for _, name := range names {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", sanitizePrometheusName(name), escapePrometheusLabel(tags[name])))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// withoutOutcomeTags returns the tags which identify a series.
+func withoutOutcomeTags(tags map[string]string) map[string]string {
+	identityTags := make(map[string]string, len(tags))
+	for name, value := range tags {
+		if !outcomeTags[name] {
+			identityTags[name] = value
+		}
+	}
+	return identityTags
+}
+
+// withPrometheusLabel appends a label to an already formatted label set.
+func withPrometheusLabel(labels, name, value string) string {
+	label := fmt.Sprintf("%s=\"%s\"", name, value)
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + label + "}"
+}
+
+func escapePrometheusLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+func formatPrometheusValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,239 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"inspector/config"
+	"inspector/mylogger"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Implementation of a write-ahead spool, a durable on disk buffer of the batches a backend failed to write.
+ * Every batch is stored in its own segment file, named after its sequence number and the number of points it holds,
+ * so the spool survives restarts and can be replayed in order. Segments are written to a temporary file first and
+ * renamed, a crash never leaves a partial segment behind.
+ * When the spool grows past its maximum size, the oldest segments are dropped.
+ * Replay attempts back off exponentially while the backend keeps failing. Batches the backend rejects, which would be
+ * rejected again on every attempt, are dropped rather than retried.
+ */
+
+var SPOOL_DEFAULT_MAX_SIZE int64 = 100 * 1024 * 1024
+var SPOOL_DEFAULT_INITIAL_BACKOFF = 10 * time.Second
+var SPOOL_DEFAULT_MAX_BACKOFF = 5 * time.Minute
+
+const spoolSegmentSuffix = ".spool"
+
+// ErrWriteRejected marks the write errors which retrying cannot fix, like malformed or conflicting points, as opposed to
+// the backend being unreachable, overloaded or misconfigured.
+var ErrWriteRejected = errors.New("write rejected")
+
+// writeRejected wraps an error as a rejection.
+func writeRejected(err error) error {
+	return fmt.Errorf("%w: %w", ErrWriteRejected, err)
+}
+
+type spoolSegment struct {
+	path   string
+	seq    uint64
+	points int
+	size   int64
+}
+
+type Spool struct {
+	directory      string
+	maxSize        int64
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	segments       []spoolSegment
+	size           int64
+	nextSeq        uint64
+	dropped        int64
+	backoff        time.Duration
+	nextAttempt    time.Time
+}
+
+// OpenSpool opens the spool directory, creating it if needed, and picks up the segments left by a previous run.
+func OpenSpool(c config.SpoolSubConfig) (*Spool, error) {
+	spool := &Spool{
+		directory:      c.Directory,
+		maxSize:        c.MaxSizeBytes,
+		initialBackoff: SPOOL_DEFAULT_INITIAL_BACKOFF,
+		maxBackoff:     SPOOL_DEFAULT_MAX_BACKOFF,
+	}
+	if spool.directory == "" {
+		return nil, fmt.Errorf("spool directory is not set")
+	}
+	if spool.maxSize <= 0 {
+		spool.maxSize = SPOOL_DEFAULT_MAX_SIZE
+	}
+	var err error
+	if c.InitialBackoff != "" {
+		spool.initialBackoff, err = time.ParseDuration(c.InitialBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spool initial backoff: %w", err)
+		}
+	}
+	if c.MaxBackoff != "" {
+		spool.maxBackoff, err = time.ParseDuration(c.MaxBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spool max backoff: %w", err)
+		}
+	}
+
+	err = os.MkdirAll(spool.directory, 0750)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(spool.directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		// Leftovers of a segment which was being written during a crash.
+		if strings.HasSuffix(name, spoolSegmentSuffix+".tmp") {
+			os.Remove(filepath.Join(spool.directory, name))
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		seqPart, pointsPart, found := strings.Cut(strings.TrimSuffix(name, spoolSegmentSuffix), "-")
+		seq, errSeq := strconv.ParseUint(seqPart, 10, 64)
+		points, errPoints := strconv.Atoi(pointsPart)
+		info, errInfo := entry.Info()
+		if !found || errSeq != nil || errPoints != nil || errInfo != nil {
+			mylogger.MainLogger.Errorf("Ignoring unexpected file in spool directory: %s", name)
+			continue
+		}
+		spool.segments = append(spool.segments, spoolSegment{
+			path:   filepath.Join(spool.directory, name),
+			seq:    seq,
+			points: points,
+			size:   info.Size(),
+		})
+		spool.size += info.Size()
+		spool.nextSeq = max(spool.nextSeq, seq+1)
+	}
+	sort.Slice(spool.segments, func(i, j int) bool {
+		return spool.segments[i].seq < spool.segments[j].seq
+	})
+	if len(spool.segments) > 0 {
+		mylogger.MainLogger.Infof("Spool %s holds %d points from a previous run", spool.directory, spool.Depth())
+	}
+	return spool, nil
+}
+
+// Append durably stores a batch of points at the end of the spool, dropping the oldest batches when the spool is full.
+func (spool *Spool) Append(data []byte, points int) error {
+	segment := spoolSegment{
+		path:   filepath.Join(spool.directory, fmt.Sprintf("%020d-%d%s", spool.nextSeq, points, spoolSegmentSuffix)),
+		seq:    spool.nextSeq,
+		points: points,
+		size:   int64(len(data)),
+	}
+	tmpPath := segment.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, segment.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	spool.nextSeq++
+	spool.segments = append(spool.segments, segment)
+	spool.size += segment.size
+
+	for spool.size > spool.maxSize && len(spool.segments) > 1 {
+		oldest := spool.segments[0]
+		mylogger.MainLogger.Errorf("Spool %s is full, dropping %d points", spool.directory, oldest.points)
+		spool.dropped += int64(oldest.points)
+		spool.remove()
+	}
+	return nil
+}
+
+// Replay writes the spooled batches in order, removing each one once written, and stops at the first failure.
+// While the writes keep failing, replay attempts are spaced by an exponential backoff. Rejected batches are dropped.
+// Replay returns true when the spool is empty.
+func (spool *Spool) Replay(write func(data []byte) error) bool {
+	if len(spool.segments) == 0 {
+		return true
+	}
+	if time.Now().Before(spool.nextAttempt) {
+		return false
+	}
+	for len(spool.segments) > 0 {
+		segment := spool.segments[0]
+		data, err := os.ReadFile(segment.path)
+		if err != nil {
+			mylogger.MainLogger.Errorf("Failed reading spool segment: %s, dropping it, error: %s", segment.path, err)
+			spool.dropped += int64(segment.points)
+			spool.remove()
+			continue
+		}
+		err = write(data)
+		if errors.Is(err, ErrWriteRejected) {
+			mylogger.MainLogger.Errorf("Spooled batch rejected: %s, dropping %d points, error: %s",
+				segment.path, segment.points, err)
+			spool.dropped += int64(segment.points)
+			spool.remove()
+			continue
+		}
+		if err != nil {
+			spool.backoff = min(max(2*spool.backoff, spool.initialBackoff), spool.maxBackoff)
+			spool.nextAttempt = time.Now().Add(spool.backoff)
+			mylogger.MainLogger.Errorf("Failed replaying spool %s, next attempt in %s, error: %s",
+				spool.directory, spool.backoff, err)
+			return false
+		}
+		spool.remove()
+	}
+	spool.backoff = 0
+	mylogger.MainLogger.Infof("Spool %s fully replayed", spool.directory)
+	return true
+}
+
+// Depth returns the number of points in the spool.
+func (spool *Spool) Depth() int {
+	depth := 0
+	for _, segment := range spool.segments {
+		depth += segment.points
+	}
+	return depth
+}
+
+// Dropped returns the number of points dropped from the spool since it was opened.
+func (spool *Spool) Dropped() int64 {
+	return spool.dropped
+}
+
+// remove deletes the oldest segment.
+func (spool *Spool) remove() {
+	oldest := spool.segments[0]
+	err := os.Remove(oldest.path)
+	if err != nil && !os.IsNotExist(err) {
+		mylogger.MainLogger.Errorf("Failed removing spool segment: %s, error: %s", oldest.path, err)
+	}
+	spool.size -= oldest.size
+	spool.segments = spool.segments[1:]
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"fmt"
+	"inspector/mylogger"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Implementation of a StatsD metrics backend, sending over udp. Latency metrics (the ones named *_time) are sent as
+ * timings, all the other metrics as gauges.
+ * With DogStatsD the tags are sent along in the DogStatsD format. Plain StatsD has no tags, the metric name is built
+ * from a template the same way the Graphite backend builds its paths.
+ * Metrics are packed into as few packets as the maximum packet size allows. StatsD timestamps the metrics on receipt,
+ * the timestamps of the metrics are not sent.
+ */
+
+// STATSD_DEFAULT_MAX_PACKET_SIZE keeps the packets within the usual network MTU.
+var STATSD_DEFAULT_MAX_PACKET_SIZE = 1432
+
+var invalidDogStatsDTagChars = regexp.MustCompile(`[,|#\n]`)
+
+type StatsD struct {
+	conn          net.Conn
+	dogStatsD     bool
+	pathTemplate  string
+	prefix        string
+	maxPacketSize int
+	lines         []string
+}
+
+// InitializeClient creates the udp socket. The database argument is not used.
+func (statsd *StatsD) InitializeClient(addr string, port int, database string) error {
+	if statsd.pathTemplate == "" {
+		statsd.pathTemplate = GRAPHITE_DEFAULT_PATH_TEMPLATE
+	}
+	if !statsd.dogStatsD && !strings.Contains(statsd.pathTemplate, "{name}") {
+		return fmt.Errorf("statsd path template must contain {name}: %s", statsd.pathTemplate)
+	}
+	if statsd.maxPacketSize <= 0 {
+		statsd.maxPacketSize = STATSD_DEFAULT_MAX_PACKET_SIZE
+	}
+	var err error
+	statsd.conn, err = net.Dial("udp", net.JoinHostPort(addr, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	statsd.lines = make([]string, 0)
+	return nil
+}
+
+// EmitSingle sends a single metric out right away.
+func (statsd *StatsD) EmitSingle(m SingleMetric) {
+	statsd.send(statsd.format(m))
+}
+
+// CollectMetrics accumulates metrics for subsequent sending.
+func (statsd *StatsD) CollectMetrics(m SingleMetric) {
+	statsd.lines = append(statsd.lines, statsd.format(m)...)
+}
+
+// EmitMultiple sends all accumulated metrics. Udp gives no delivery guarantee, metrics which cannot be sent are dropped.
+func (statsd *StatsD) EmitMultiple() {
+	statsd.send(statsd.lines)
+	statsd.lines = statsd.lines[:0]
+}
+
+// Close closes the udp socket.
+func (statsd *StatsD) Close() error {
+	return statsd.conn.Close()
+}
+
+// send packs the lines into packets of at most the maximum packet size.
+func (statsd *StatsD) send(lines []string) {
+	var packet strings.Builder
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		_, err := statsd.conn.Write([]byte(packet.String()))
+		if err != nil {
+			mylogger.MainLogger.Errorf("Error writing to StatsD: %s", err)
+		}
+		packet.Reset()
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsd.maxPacketSize {
+			flush()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	flush()
+}
+
+// format converts the metric into StatsD lines, <name>:<value>|<type>[|#<tags>].
+func (statsd *StatsD) format(m SingleMetric) []string {
+	metricType := "g"
+	if strings.HasSuffix(m.Name, "_time") {
+		metricType = "ms"
+	}
+
+	if statsd.dogStatsD {
+		name := sanitizeGraphiteComponent(m.Name)
+		if statsd.prefix != "" {
+			name = statsd.prefix + "." + name
+		}
+		line := fmt.Sprintf("%s:%s|%s", name, formatMetricValue(m.Value), metricType)
+		if len(m.Tags) > 0 {
+			tags := make([]string, 0, len(m.Tags))
+			for key, value := range m.Tags {
+				tags = append(tags, sanitizeDogStatsDTag(key)+":"+sanitizeDogStatsDTag(value))
+			}
+			sort.Strings(tags)
+			line += "|#" + strings.Join(tags, ",")
+		}
+		return []string{line}
+	}
+
+	name := renderMetricPath(statsd.pathTemplate, statsd.prefix, m)
+	// A signed gauge value is a relative change in plain StatsD, negative gauges have to be reset to zero first.
+	if metricType == "g" && m.Value < 0 {
+		return []string{fmt.Sprintf("%s:0|g", name), fmt.Sprintf("%s:%s|g", name, formatMetricValue(m.Value))}
+	}
+	return []string{fmt.Sprintf("%s:%s|%s", name, formatMetricValue(m.Value), metricType)}
+}
+
+func sanitizeDogStatsDTag(value string) string {
+	return invalidDogStatsDTagChars.ReplaceAllString(value, "_")
+}
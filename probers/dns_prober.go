@@ -0,0 +1,202 @@
+package probers
+
+import (
+	"fmt"
+	"inspector/metrics"
+	"inspector/mylogger"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+/*
+ * Implementation of the dns prober. It queries the configured resolver for a name and record type, and asserts on the
+ * answers, the response code and the TTL of the answers.
+ * DNS prober exports these 4 metrics: query_time, rcode, answer_count and success. When an assertion fails, success is
+ * exported with a failed_assertion tag naming the failed check.
+ */
+
+var supportedQueryTypes = map[string]uint16{
+	"A":     dns.TypeA,
+	"AAAA":  dns.TypeAAAA,
+	"CNAME": dns.TypeCNAME,
+	"MX":    dns.TypeMX,
+	"TXT":   dns.TypeTXT,
+	"SRV":   dns.TypeSRV,
+	"NS":    dns.TypeNS,
+	"SOA":   dns.TypeSOA,
+}
+
+type DNSProber struct {
+	TargetID        string
+	ProberID        string
+	Resolver        string
+	Protocol        string
+	QueryName       string
+	QueryType       string
+	ExpectedAnswers []string
+	ExpectedRcode   string
+	MinTTL          uint32
+	MaxTTL          uint32
+	Timeout         string
+	qtype           uint16
+	rcode           int
+	client          *dns.Client
+	conn            *dns.Conn
+}
+
+func (dnsProber *DNSProber) Initialize(targetID, proberID string) error {
+	dnsProber.TargetID = targetID
+	dnsProber.ProberID = proberID
+
+	var ok bool
+	dnsProber.qtype, ok = supportedQueryTypes[strings.ToUpper(dnsProber.QueryType)]
+	if !ok {
+		return fmt.Errorf("unsupported query type: %s", dnsProber.QueryType)
+	}
+	if dnsProber.QueryName == "" {
+		return fmt.Errorf("missing query name")
+	}
+
+	dnsProber.rcode = dns.RcodeSuccess
+	if dnsProber.ExpectedRcode != "" {
+		dnsProber.rcode, ok = dns.StringToRcode[strings.ToUpper(dnsProber.ExpectedRcode)]
+		if !ok {
+			return fmt.Errorf("unsupported rcode: %s", dnsProber.ExpectedRcode)
+		}
+	}
+
+	// Resolvers are usually configured without the port.
+	if _, _, err := net.SplitHostPort(dnsProber.Resolver); err != nil {
+		dnsProber.Resolver = net.JoinHostPort(dnsProber.Resolver, "53")
+	}
+
+	switch dnsProber.Protocol {
+	case "":
+		dnsProber.Protocol = "udp"
+	case "udp", "tcp":
+	default:
+		return fmt.Errorf("unsupported transport protocol: %s", dnsProber.Protocol)
+	}
+
+	timeout, err := time.ParseDuration(dnsProber.Timeout)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Invalid timeout duration: %s", err)
+		return err
+	}
+	dnsProber.client = &dns.Client{
+		Net:     dnsProber.Protocol,
+		Timeout: timeout,
+	}
+	return nil
+}
+
+func (dnsProber *DNSProber) Connect(c chan metrics.SingleMetric) error {
+	var err error
+	dnsProber.conn, err = dnsProber.client.Dial(dnsProber.Resolver)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Connection Failed for resolver %s. Error: %s", dnsProber.Resolver, err)
+		return err
+	}
+	return nil
+}
+
+func (dnsProber *DNSProber) RunOnce(c chan metrics.SingleMetric) error {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(dnsProber.QueryName), dnsProber.qtype)
+
+	response, rtt, err := dnsProber.client.ExchangeWithConn(msg, dnsProber.conn)
+	if err != nil {
+		c <- metrics.CreateSingleMetric("success", 0, nil, dnsProber.tagsWith("failed_assertion", "query"))
+		return err
+	}
+
+	c <- metrics.CreateSingleMetric("query_time", metrics.Milliseconds(rtt), nil, dnsProber.tags())
+	c <- metrics.CreateSingleMetric("rcode", float64(response.Rcode), nil, dnsProber.tags())
+	c <- metrics.CreateSingleMetric("answer_count", float64(len(response.Answer)), nil, dnsProber.tags())
+
+	failed := dnsProber.validate(response)
+	if failed != "" {
+		mylogger.MainLogger.Infof("DNS assertion failed for %s %s: %s", dnsProber.QueryName, dnsProber.QueryType,
+			failed)
+		c <- metrics.CreateSingleMetric("success", 0, nil, dnsProber.tagsWith("failed_assertion", failed))
+		return nil
+	}
+	c <- metrics.CreateSingleMetric("success", 1, nil, dnsProber.tags())
+	return nil
+}
+
+// validate returns the name of the first failed assertion, or an empty string when the response is as expected.
+func (dnsProber *DNSProber) validate(response *dns.Msg) string {
+	if response.Rcode != dnsProber.rcode {
+		return "rcode"
+	}
+
+	answers := make([]string, 0, len(response.Answer))
+	for _, rr := range response.Answer {
+		ttl := rr.Header().Ttl
+		if (dnsProber.MinTTL != 0 && ttl < dnsProber.MinTTL) || (dnsProber.MaxTTL != 0 && ttl > dnsProber.MaxTTL) {
+			return "ttl"
+		}
+		answers = append(answers, answerData(rr))
+	}
+
+	for _, expected := range dnsProber.ExpectedAnswers {
+		found := false
+		for _, answer := range answers {
+			if strings.EqualFold(normalizeAnswer(expected), answer) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "answers"
+		}
+	}
+	return ""
+}
+
+// answerData returns the data part of a resource record in its presentation format, e.g. "10 mx.example.com" for
+// an MX record.
+func answerData(rr dns.RR) string {
+	data := strings.TrimPrefix(rr.String(), rr.Header().String())
+	return normalizeAnswer(data)
+}
+
+// normalizeAnswer strips the parts of the presentation format which are irrelevant for comparison, like the quotes
+// around TXT records and the trailing dot of fully qualified names.
+func normalizeAnswer(answer string) string {
+	answer = strings.TrimSpace(answer)
+	answer = strings.Trim(answer, "\"")
+	return strings.TrimSuffix(answer, ".")
+}
+
+func (dnsProber *DNSProber) TearDown() error {
+	if dnsProber.conn == nil {
+		return nil
+	}
+	return dnsProber.conn.Close()
+}
+
+func (dnsProber *DNSProber) tags() map[string]string {
+	return map[string]string{
+		"target_id": dnsProber.getTargetID(),
+		"prober_id": dnsProber.getProberID(),
+	}
+}
+
+func (dnsProber *DNSProber) tagsWith(key, value string) map[string]string {
+	tags := dnsProber.tags()
+	tags[key] = value
+	return tags
+}
+
+func (dnsProber *DNSProber) getTargetID() string {
+	return dnsProber.TargetID
+}
+
+func (dnsProber *DNSProber) getProberID() string {
+	return dnsProber.ProberID
+}
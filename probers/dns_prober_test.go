@@ -0,0 +1,162 @@
+package probers
+
+import (
+	"inspector/metrics"
+	"inspector/mylogger"
+	"io"
+	"net"
+	"testing"
+
+	glogger "github.com/google/logger"
+	"github.com/miekg/dns"
+)
+
+func init() {
+	if mylogger.MainLogger == nil {
+		mylogger.MainLogger = glogger.Init("InspectorTestLogger", false, false, io.Discard)
+	}
+}
+
+// startDNSServer serves the zone of example.com on a random local udp port and returns its address.
+func startDNSServer(t *testing.T) string {
+	t.Helper()
+	mux := dns.NewServeMux()
+	mux.HandleFunc("example.com.", func(w dns.ResponseWriter, r *dns.Msg) {
+		response := new(dns.Msg)
+		response.SetReply(r)
+		switch r.Question[0].Qtype {
+		case dns.TypeA:
+			rr, _ := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+			response.Answer = append(response.Answer, rr)
+		case dns.TypeMX:
+			rr, _ := dns.NewRR("example.com. 60 IN MX 10 mx.example.com.")
+			response.Answer = append(response.Answer, rr)
+		}
+		w.WriteMsg(response)
+	})
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		response := new(dns.Msg)
+		response.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(response)
+	})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: mux, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+// runDNSProber runs the prober once and returns the metrics it exported, by name.
+func runDNSProber(t *testing.T, prober *DNSProber) map[string]metrics.SingleMetric {
+	t.Helper()
+	prober.Timeout = "2s"
+	err := prober.Initialize("target", "prober")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan metrics.SingleMetric, 10)
+	err = prober.Connect(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prober.TearDown()
+	err = prober.RunOnce(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(c)
+	exported := make(map[string]metrics.SingleMetric)
+	for m := range c {
+		exported[m.Name] = m
+	}
+	return exported
+}
+
+func TestDNSProberAssertions(t *testing.T) {
+	resolver := startDNSServer(t)
+	tests := []struct {
+		name            string
+		prober          DNSProber
+		failedAssertion string
+	}{
+		{
+			name:   "matching answer",
+			prober: DNSProber{QueryName: "example.com", QueryType: "A", ExpectedAnswers: []string{"192.0.2.1"}},
+		},
+		{
+			name:   "matching mx answer",
+			prober: DNSProber{QueryName: "example.com", QueryType: "MX", ExpectedAnswers: []string{"10 mx.example.com."}},
+		},
+		{
+			name:            "missing answer",
+			prober:          DNSProber{QueryName: "example.com", QueryType: "A", ExpectedAnswers: []string{"192.0.2.2"}},
+			failedAssertion: "answers",
+		},
+		{
+			name:            "unexpected rcode",
+			prober:          DNSProber{QueryName: "missing.org", QueryType: "A"},
+			failedAssertion: "rcode",
+		},
+		{
+			name:   "expected rcode",
+			prober: DNSProber{QueryName: "missing.org", QueryType: "A", ExpectedRcode: "NXDOMAIN"},
+		},
+		{
+			name:   "ttl within bounds",
+			prober: DNSProber{QueryName: "example.com", QueryType: "A", MinTTL: 60, MaxTTL: 3600},
+		},
+		{
+			name:            "ttl below minimum",
+			prober:          DNSProber{QueryName: "example.com", QueryType: "MX", MinTTL: 120},
+			failedAssertion: "ttl",
+		},
+		{
+			name:            "ttl above maximum",
+			prober:          DNSProber{QueryName: "example.com", QueryType: "A", MaxTTL: 120},
+			failedAssertion: "ttl",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prober := test.prober
+			prober.Resolver = resolver
+			exported := runDNSProber(t, &prober)
+
+			for _, name := range []string{"query_time", "rcode", "answer_count", "success"} {
+				if _, ok := exported[name]; !ok {
+					t.Fatalf("metric %s was not exported", name)
+				}
+			}
+			success := exported["success"]
+			if test.failedAssertion == "" {
+				if success.Value != 1 {
+					t.Errorf("success = %v, failed assertion: %s", success.Value, success.Tags["failed_assertion"])
+				}
+				return
+			}
+			if success.Value != 0 {
+				t.Errorf("success = %v, want 0", success.Value)
+			}
+			if success.Tags["failed_assertion"] != test.failedAssertion {
+				t.Errorf("failed_assertion = %q, want %q", success.Tags["failed_assertion"], test.failedAssertion)
+			}
+		})
+	}
+}
+
+func TestDNSProberRcodeMetric(t *testing.T) {
+	prober := DNSProber{Resolver: startDNSServer(t), QueryName: "missing.org", QueryType: "A"}
+	exported := runDNSProber(t, &prober)
+	if exported["rcode"].Value != dns.RcodeNameError {
+		t.Errorf("rcode = %v, want %d", exported["rcode"].Value, dns.RcodeNameError)
+	}
+	if exported["answer_count"].Value != 0 {
+		t.Errorf("answer_count = %v, want 0", exported["answer_count"].Value)
+	}
+}
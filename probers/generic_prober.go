@@ -27,8 +27,6 @@ type Prober interface {
 }
 
 // NewProber creates a new prober using the type specific in the configuration file
-// Currently only basic http prober is supported.
-// TODO: add more prober types.
 func NewProber(c config.ProberSubConfig) (Prober, error) {
 	var newProber Prober
 	switch c.Name {
@@ -37,9 +35,50 @@ func NewProber(c config.ProberSubConfig) (Prober, error) {
 			Url:            c.Context.Url,
 			Method:         c.Context.Method,
 			Parameters:     c.Context.RequestParameters,
+			Headers:        c.Context.Headers,
+			Body:           c.Context.Body,
+			BodyFile:       c.Context.BodyFile,
+			BodyJSON:       c.Context.BodyJSON,
+			ContentType:    c.Context.ContentType,
+			Auth:           c.Context.Auth,
+			TLS:            c.Context.TLS,
 			Cookies:        c.Context.Cookies,
 			AllowRedirects: c.Context.AllowRedirects,
 			Timeout:        c.Context.Timeout,
+			Validations:    c.Context.Validations,
+		}
+	case "tcp_prober":
+		newProber = &TCPProber{
+			Address:          c.Context.Address,
+			Payload:          c.Context.Payload,
+			ExpectedResponse: c.Context.ExpectedResponse,
+			Timeout:          c.Context.Timeout,
+		}
+	case "dns_prober":
+		newProber = &DNSProber{
+			Resolver:        c.Context.Address,
+			Protocol:        c.Context.TransportProtocol,
+			QueryName:       c.Context.QueryName,
+			QueryType:       c.Context.QueryType,
+			ExpectedAnswers: c.Context.ExpectedAnswers,
+			ExpectedRcode:   c.Context.ExpectedRcode,
+			MinTTL:          c.Context.MinTTL,
+			MaxTTL:          c.Context.MaxTTL,
+			Timeout:         c.Context.Timeout,
+		}
+	case "tls_prober":
+		newProber = &TLSProber{
+			Address:  c.Context.Address,
+			StartTLS: c.Context.StartTLS,
+			TLS:      c.Context.TLS,
+			Timeout:  c.Context.Timeout,
+		}
+	case "icmp_prober":
+		newProber = &ICMPProber{
+			Address:        c.Context.Address,
+			Count:          c.Context.Count,
+			PacketInterval: c.Context.PacketInterval,
+			Timeout:        c.Context.Timeout,
 		}
 	default:
 		return nil, fmt.Errorf("unsupported prober type: %s", c.Name)
@@ -0,0 +1,182 @@
+package probers
+
+import (
+	"encoding/json"
+	"fmt"
+	"inspector/config"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Authentication of the http prober requests.
+ * Probers are not reused, so the oauth2 tokens are cached at the package level and shared by all the probers using the
+ * same token url, client and scopes.
+ */
+
+// OAUTH2_TOKEN_EXPIRY_MARGIN renews oauth2 tokens this long before they expire, so they don't expire mid request.
+var OAUTH2_TOKEN_EXPIRY_MARGIN = 30 * time.Second
+
+// OAUTH2_DEFAULT_TOKEN_LIFETIME is used for tokens issued without an expires_in.
+var OAUTH2_DEFAULT_TOKEN_LIFETIME = 5 * time.Minute
+
+type oauth2Token struct {
+	accessToken string
+	tokenType   string
+	expiry      time.Time
+}
+
+// oauth2TokenEntry caches the token of a token url, client and scopes. Its lock is held while the token is fetched, so
+// the probers sharing the token fetch it once, without waiting on the token urls of other probers.
+type oauth2TokenEntry struct {
+	sync.Mutex
+	token oauth2Token
+}
+
+var oauth2TokenCache = struct {
+	sync.Mutex
+	entries map[string]*oauth2TokenEntry
+}{entries: make(map[string]*oauth2TokenEntry)}
+
+// validateAuth checks the auth config holds what its type needs.
+func validateAuth(auth *config.HTTPAuthSubConfig) error {
+	if auth == nil {
+		return nil
+	}
+	switch auth.Type {
+	case "basic":
+		if auth.Username == "" {
+			return fmt.Errorf("basic auth requires a username")
+		}
+	case "bearer":
+		if auth.Token == "" {
+			return fmt.Errorf("bearer auth requires a token")
+		}
+	case "api_key":
+		if auth.APIKey == "" {
+			return fmt.Errorf("api_key auth requires an api_key")
+		}
+	case "oauth2":
+		if auth.TokenURL == "" || auth.ClientID == "" {
+			return fmt.Errorf("oauth2 auth requires a token_url and a client_id")
+		}
+	default:
+		return fmt.Errorf("unsupported auth type: %s", auth.Type)
+	}
+	return nil
+}
+
+// authorize adds the configured credentials to the request.
+func (httpProber *HTTPProber) authorize(request *http.Request) error {
+	auth := httpProber.Auth
+	if auth == nil {
+		return nil
+	}
+	switch auth.Type {
+	case "basic":
+		request.SetBasicAuth(auth.Username, auth.Password)
+	case "bearer":
+		request.Header.Set("Authorization", "Bearer "+auth.Token)
+	case "api_key":
+		header := auth.HeaderName
+		if header == "" {
+			header = "X-API-Key"
+		}
+		request.Header.Set(header, auth.APIKey)
+	case "oauth2":
+		token, err := httpProber.oauth2Token()
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", token.tokenType+" "+token.accessToken)
+	}
+	return nil
+}
+
+// oauth2Token returns a cached token, or fetches a new one from the token url when there is no valid token cached.
+func (httpProber *HTTPProber) oauth2Token() (oauth2Token, error) {
+	auth := httpProber.Auth
+	key := strings.Join([]string{auth.TokenURL, auth.ClientID, strings.Join(auth.Scopes, " ")}, "|")
+
+	oauth2TokenCache.Lock()
+	entry, ok := oauth2TokenCache.entries[key]
+	if !ok {
+		entry = &oauth2TokenEntry{}
+		oauth2TokenCache.entries[key] = entry
+	}
+	oauth2TokenCache.Unlock()
+
+	entry.Lock()
+	defer entry.Unlock()
+	if time.Now().Add(OAUTH2_TOKEN_EXPIRY_MARGIN).Before(entry.token.expiry) {
+		return entry.token, nil
+	}
+	token, err := httpProber.fetchOAuth2Token()
+	if err != nil {
+		return oauth2Token{}, err
+	}
+	entry.token = token
+	return token, nil
+}
+
+// fetchOAuth2Token requests a new token from the token url with the client credentials grant.
+func (httpProber *HTTPProber) fetchOAuth2Token() (oauth2Token, error) {
+	auth := httpProber.Auth
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(auth.Scopes) > 0 {
+		form.Set("scope", strings.Join(auth.Scopes, " "))
+	}
+	request, err := http.NewRequest(http.MethodPost, auth.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oauth2Token{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(auth.ClientID), url.QueryEscape(auth.ClientSecret))
+
+	// The token request does not go through the prober's client, it must not be traced nor carry the prober's cookies.
+	client := &http.Client{
+		Timeout:   httpProber.client.Timeout,
+		Transport: httpProber.client.Transport,
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return oauth2Token{}, fmt.Errorf("failed fetching oauth2 token: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return oauth2Token{}, fmt.Errorf("failed fetching oauth2 token, status: %s", response.Status)
+	}
+
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&tokenResponse)
+	if err != nil {
+		return oauth2Token{}, fmt.Errorf("failed decoding oauth2 token: %w", err)
+	}
+	if tokenResponse.AccessToken == "" {
+		return oauth2Token{}, fmt.Errorf("oauth2 token response has no access_token")
+	}
+
+	lifetime := OAUTH2_DEFAULT_TOKEN_LIFETIME
+	if tokenResponse.ExpiresIn > 0 {
+		lifetime = time.Duration(tokenResponse.ExpiresIn) * time.Second
+	}
+	token := oauth2Token{
+		accessToken: tokenResponse.AccessToken,
+		tokenType:   "Bearer",
+		expiry:      time.Now().Add(lifetime),
+	}
+	// Token types are case insensitive, but plenty of servers only accept the canonical Bearer.
+	if tokenResponse.TokenType != "" && !strings.EqualFold(tokenResponse.TokenType, "bearer") {
+		token.tokenType = tokenResponse.TokenType
+	}
+	return token, nil
+}
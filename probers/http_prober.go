@@ -1,47 +1,122 @@
 package probers
 
 import (
-	"context"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"inspector/config"
 	"inspector/metrics"
 	"inspector/mylogger"
-	"net"
+	"io"
 	"net/http"
 	"net/http/cookiejar"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"strings"
 	"time"
 )
 
 /*
  * This is an implementation of a prober called: basic http prober. It currently supports limited features, but should be
  * simple to extend from here.
- * Basic http prober currently exports these 3 metrics: connect_time, status and request_time.
- * TODO: add POST support, parameters support, HTTPS support to the basic http prober.
+ * Basic http prober currently exports the status and certificate_expiration metrics, along with the duration of every
+ * phase of the request: dns_lookup_time, connect_time, tls_handshake_time, first_byte_time, content_transfer_time and
+ * the total response_time. The success metric reports whether the response passed the configured validations, a failed
+ * probe is tagged with the name of the failed assertion.
+ * All the standard methods are supported, with an optional request body and arbitrary request headers. Requests can be
+ * authenticated with basic auth, a bearer token, an api key or an oauth2 client credentials token.
  */
 
 type HTTPProber struct {
 	TargetID       string
 	ProberID       string
-	Interval       time.Duration
 	Url            string
 	Method         string
 	Parameters     map[string]string
+	Headers        map[string]string
+	Body           string
+	BodyFile       string
+	BodyJSON       interface{}
+	ContentType    string
+	Auth           *config.HTTPAuthSubConfig
+	TLS            *config.TLSSubConfig
 	Cookies        map[string]string
 	AllowRedirects bool
 	Timeout        string
+	Validations    *config.HTTPValidationsSubConfig
 	client         *http.Client
+	validator      *httpValidator
+	tlsConfig      *tls.Config
+	body           []byte
+}
+
+// supportedHTTPMethods lists the methods the http prober can issue.
+var supportedHTTPMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
 }
 
 func (httpProber *HTTPProber) Initialize(targetID, proberID string) error {
 	httpProber.TargetID = targetID
 	httpProber.ProberID = proberID
-	return nil
+
+	httpProber.Method = strings.ToUpper(httpProber.Method)
+	if !supportedHTTPMethods[httpProber.Method] {
+		return fmt.Errorf("unsupported method: %s", httpProber.Method)
+	}
+
+	var err error
+	httpProber.body, err = httpProber.requestBody()
+	if err != nil {
+		return err
+	}
+	httpProber.validator, err = newHTTPValidator(httpProber.Validations)
+	if err != nil {
+		return err
+	}
+	httpProber.tlsConfig, err = newTLSConfig(httpProber.TLS)
+	if err != nil {
+		return fmt.Errorf("invalid tls configuration: %w", err)
+	}
+	return validateAuth(httpProber.Auth)
 }
 
-// Connect starts a new connection. We need a new connection on each Connect() invocation because we want to measure
-// the connection time from scratch.
+// requestBody builds the request body out of the one configured body source.
+func (httpProber *HTTPProber) requestBody() ([]byte, error) {
+	sources := 0
+	for _, set := range []bool{httpProber.Body != "", httpProber.BodyFile != "", httpProber.BodyJSON != nil} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, fmt.Errorf("only one of body, body_file and body_json can be set")
+	}
+
+	switch {
+	case httpProber.Body != "":
+		return []byte(httpProber.Body), nil
+	case httpProber.BodyFile != "":
+		return os.ReadFile(httpProber.BodyFile)
+	case httpProber.BodyJSON != nil:
+		if httpProber.ContentType == "" {
+			httpProber.ContentType = "application/json"
+		}
+		return json.Marshal(httpProber.BodyJSON)
+	}
+	return nil, nil
+}
+
+// Connect prepares a new http client. Keep alives are disabled because we want to measure the connection time from
+// scratch on every run.
 func (httpProber *HTTPProber) Connect(c chan metrics.SingleMetric) error {
-	//TODO: handle https urls in httpProber
 	timeoutDuration, err := time.ParseDuration(httpProber.Timeout)
 	if err != nil {
 		mylogger.MainLogger.Errorf("Invalid timeout duration: %s", err)
@@ -49,21 +124,7 @@ func (httpProber *HTTPProber) Connect(c chan metrics.SingleMetric) error {
 	}
 
 	transport := &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			start := time.Now()
-			conn, err := net.Dial(network, addr)
-			if err != nil {
-				mylogger.MainLogger.Errorf("Connection Failed for URL %s. Method: %s. Error: %s",
-					httpProber.Url, httpProber.Method, err)
-				return nil, err
-			}
-			c <- metrics.CreateSingleMetric("connect_time", time.Since(start).Milliseconds(), nil,
-				map[string]string{
-					"target_id": httpProber.getTargetID(),
-					"prober_id": httpProber.getProberID(),
-				})
-			return conn, nil
-		},
+		TLSClientConfig:   httpProber.tlsConfig,
 		DisableKeepAlives: true,
 	}
 	httpProber.client = &http.Client{
@@ -98,10 +159,6 @@ func (httpProber *HTTPProber) Connect(c chan metrics.SingleMetric) error {
 }
 
 func (httpProber *HTTPProber) RunOnce(c chan metrics.SingleMetric) error {
-	var response *http.Response
-	var err error
-	var start time.Time
-
 	params := url.Values{}
 	for name, value := range httpProber.Parameters {
 		params.Add(name, value)
@@ -109,23 +166,68 @@ func (httpProber *HTTPProber) RunOnce(c chan metrics.SingleMetric) error {
 	baseURL, _ := url.Parse(httpProber.Url)
 	baseURL.RawQuery = params.Encode()
 
-	if httpProber.Method == "GET" {
-		start = time.Now()
-		response, err = httpProber.client.Get(baseURL.String())
-		if err != nil {
-			return err
+	var requestBody io.Reader
+	if httpProber.body != nil {
+		requestBody = bytes.NewReader(httpProber.body)
+	}
+	request, err := http.NewRequest(httpProber.Method, baseURL.String(), requestBody)
+	if err != nil {
+		return err
+	}
+	for name, value := range httpProber.Headers {
+		// net/http ignores the Host header, the host of a virtual host probe is set on the request itself.
+		if http.CanonicalHeaderKey(name) == "Host" {
+			request.Host = value
+			continue
 		}
-	} else {
-		return fmt.Errorf("unsupported method: %s", httpProber.Method)
+		request.Header.Set(name, value)
+	}
+	if httpProber.ContentType != "" {
+		request.Header.Set("Content-Type", httpProber.ContentType)
 	}
+	err = httpProber.authorize(request)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Authorization Failed for URL %s. Error: %s", httpProber.Url, err)
+		c <- metrics.CreateSingleMetric("success", 0, nil,
+			map[string]string{
+				"target_id":        httpProber.getTargetID(),
+				"prober_id":        httpProber.getProberID(),
+				"failed_assertion": "auth",
+			})
+		return err
+	}
+	timings := &httpTimings{}
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), timings.clientTrace()))
 
-	c <- metrics.CreateSingleMetric("response_time", time.Since(start).Milliseconds(), nil,
-		map[string]string{
-			"target_id": httpProber.getTargetID(),
-			"prober_id": httpProber.getProberID(),
-		})
+	start := time.Now()
+	response, err := httpProber.client.Do(request)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Request Failed for URL %s. Method: %s. Error: %s",
+			httpProber.Url, httpProber.Method, err)
+		c <- metrics.CreateSingleMetric("success", 0, nil,
+			map[string]string{
+				"target_id":        httpProber.getTargetID(),
+				"prober_id":        httpProber.getProberID(),
+				"failed_assertion": "request",
+			})
+		return err
+	}
+	defer response.Body.Close()
+
+	// The body has to be read in full to measure the content transfer. Only the beginning of it is kept for validation.
+	body, err := io.ReadAll(io.LimitReader(response.Body, HTTP_MAX_VALIDATED_BODY_SIZE))
+	if err != nil {
+		return err
+	}
+	remainder, err := io.Copy(io.Discard, response.Body)
+	if err != nil {
+		return err
+	}
+	end := time.Now()
+
+	httpProber.emitTimings(c, timings, start, end)
 
-	c <- metrics.CreateSingleMetric("status", int64(response.StatusCode), nil,
+	c <- metrics.CreateSingleMetric("status", float64(response.StatusCode), nil,
 		map[string]string{
 			"target_id": httpProber.getTargetID(),
 			"prober_id": httpProber.getProberID(),
@@ -133,17 +235,51 @@ func (httpProber *HTTPProber) RunOnce(c chan metrics.SingleMetric) error {
 
 	if response.TLS != nil {
 		c <- metrics.CreateSingleMetric("certificate_expiration",
-			int64(response.TLS.PeerCertificates[0].NotAfter.Sub(time.Now()).Hours())/24, nil,
+			float64(int64(response.TLS.PeerCertificates[0].NotAfter.Sub(time.Now()).Hours())/24), nil,
 			map[string]string{
 				"target_id": httpProber.getTargetID(),
 				"prober_id": httpProber.getProberID(),
 			})
 	}
 
-	response.Body.Close()
+	tags := map[string]string{
+		"target_id": httpProber.getTargetID(),
+		"prober_id": httpProber.getProberID(),
+	}
+	failed := httpProber.validator.validate(response, body, int64(len(body))+remainder)
+	if failed != "" {
+		mylogger.MainLogger.Infof("HTTP assertion failed for URL %s: %s", httpProber.Url, failed)
+		tags["failed_assertion"] = failed
+		c <- metrics.CreateSingleMetric("success", 0, nil, tags)
+		return nil
+	}
+	c <- metrics.CreateSingleMetric("success", 1, nil, tags)
 	return nil
 }
 
+// emitTimings exports the duration of every phase of the request which took place. Phases which did not happen, like
+// the dns lookup of an ip address or the tls handshake of a plain http request, are not exported.
+func (httpProber *HTTPProber) emitTimings(c chan metrics.SingleMetric, timings *httpTimings, start, end time.Time) {
+	timings.lock.Lock()
+	defer timings.lock.Unlock()
+	emit := func(name string, from, to time.Time) {
+		if from.IsZero() || to.IsZero() {
+			return
+		}
+		c <- metrics.CreateSingleMetric(name, metrics.Milliseconds(to.Sub(from)), nil,
+			map[string]string{
+				"target_id": httpProber.getTargetID(),
+				"prober_id": httpProber.getProberID(),
+			})
+	}
+	emit("dns_lookup_time", timings.dnsStart, timings.dnsDone)
+	emit("connect_time", timings.connectStart, timings.connectDone)
+	emit("tls_handshake_time", timings.tlsStart, timings.tlsDone)
+	emit("first_byte_time", start, timings.firstByte)
+	emit("content_transfer_time", timings.firstByte, end)
+	emit("response_time", start, end)
+}
+
 func (httpProber *HTTPProber) TearDown() error {
 	httpProber.client.CloseIdleConnections()
 	return nil
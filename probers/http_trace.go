@@ -0,0 +1,83 @@
+package probers
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// httpTimings records the moments at which the phases of an http request start and end. When the request is
+// redirected, the phases are the ones of the last request of the chain.
+// The hooks of a dual stack dial run concurrently, one per connection attempt, so the timings are locked and the
+// connect phase is the one of the attempt which established the connection.
+type httpTimings struct {
+	lock          sync.Mutex
+	dnsStart      time.Time
+	dnsDone       time.Time
+	connectStarts map[string]time.Time
+	connectStart  time.Time
+	connectDone   time.Time
+	tlsStart      time.Time
+	tlsDone       time.Time
+	firstByte     time.Time
+}
+
+func (timings *httpTimings) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			timings.lock.Lock()
+			defer timings.lock.Unlock()
+			// Every request of a redirect chain gets its own connection, only the phases of the last one are kept. A
+			// reused connection has no dns, connect nor tls phase.
+			timings.dnsStart, timings.dnsDone = time.Time{}, time.Time{}
+			timings.connectStarts = make(map[string]time.Time)
+			timings.connectStart, timings.connectDone = time.Time{}, time.Time{}
+			timings.tlsStart, timings.tlsDone = time.Time{}, time.Time{}
+			timings.firstByte = time.Time{}
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			timings.lock.Lock()
+			defer timings.lock.Unlock()
+			timings.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			timings.lock.Lock()
+			defer timings.lock.Unlock()
+			timings.dnsDone = time.Now()
+		},
+		ConnectStart: func(network, addr string) {
+			timings.lock.Lock()
+			defer timings.lock.Unlock()
+			if timings.connectStarts == nil {
+				timings.connectStarts = make(map[string]time.Time)
+			}
+			timings.connectStarts[addr] = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			timings.lock.Lock()
+			defer timings.lock.Unlock()
+			// The first established connection is the one used, the attempts racing it are cancelled.
+			if err != nil || !timings.connectDone.IsZero() {
+				return
+			}
+			timings.connectStart = timings.connectStarts[addr]
+			timings.connectDone = time.Now()
+		},
+		TLSHandshakeStart: func() {
+			timings.lock.Lock()
+			defer timings.lock.Unlock()
+			timings.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			timings.lock.Lock()
+			defer timings.lock.Unlock()
+			timings.tlsDone = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			timings.lock.Lock()
+			defer timings.lock.Unlock()
+			timings.firstByte = time.Now()
+		},
+	}
+}
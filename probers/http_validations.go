@@ -0,0 +1,199 @@
+package probers
+
+import (
+	"encoding/json"
+	"fmt"
+	"inspector/config"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Assertions run against the response of the http prober. Every failed assertion is named by the failed_assertion tag
+ * of the success metric, the names are the json names of the corresponding validations config stanzas.
+ */
+
+// HTTP_MAX_VALIDATED_BODY_SIZE caps how much of the response body is kept in memory for the body assertions.
+var HTTP_MAX_VALIDATED_BODY_SIZE int64 = 10 * 1024 * 1024
+
+// statusCodeRange is an inclusive range of accepted status codes.
+type statusCodeRange struct {
+	from int
+	to   int
+}
+
+// jsonPathCheck is a json_path assertion with its path parsed.
+type jsonPathCheck struct {
+	path  jsonPath
+	value interface{}
+}
+
+type httpValidator struct {
+	statusCodes      []statusCodeRange
+	requiredHeaders  map[string]*regexp.Regexp
+	forbiddenHeaders []string
+	bodyContains     []string
+	bodyNotContains  []string
+	bodyRegex        []*regexp.Regexp
+	bodyNotRegex     []*regexp.Regexp
+	jsonPath         []jsonPathCheck
+	maxBodySize      int64
+}
+
+// newHTTPValidator compiles the validations config. A nil config only accepts 2xx and 3xx status codes.
+func newHTTPValidator(c *config.HTTPValidationsSubConfig) (*httpValidator, error) {
+	validator := &httpValidator{
+		statusCodes: []statusCodeRange{{from: 200, to: 399}},
+	}
+	if c == nil {
+		return validator, nil
+	}
+
+	if len(c.StatusCodes) > 0 {
+		validator.statusCodes = nil
+		for _, code := range c.StatusCodes {
+			r, err := parseStatusCodeRange(string(code))
+			if err != nil {
+				return nil, err
+			}
+			validator.statusCodes = append(validator.statusCodes, r)
+		}
+	}
+
+	validator.requiredHeaders = make(map[string]*regexp.Regexp)
+	for header, pattern := range c.RequiredHeaders {
+		var re *regexp.Regexp
+		if pattern != "" {
+			var err error
+			re, err = regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression for header %s: %w", header, err)
+			}
+		}
+		validator.requiredHeaders[header] = re
+	}
+
+	for _, pattern := range c.BodyRegex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body regular expression: %w", err)
+		}
+		validator.bodyRegex = append(validator.bodyRegex, re)
+	}
+	for _, pattern := range c.BodyNotRegex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body regular expression: %w", err)
+		}
+		validator.bodyNotRegex = append(validator.bodyNotRegex, re)
+	}
+
+	for _, check := range c.JSONPath {
+		path, err := parseJSONPath(check.Path)
+		if err != nil {
+			return nil, err
+		}
+		validator.jsonPath = append(validator.jsonPath, jsonPathCheck{path: path, value: check.Value})
+	}
+
+	validator.forbiddenHeaders = c.ForbiddenHeaders
+	validator.bodyContains = c.BodyContains
+	validator.bodyNotContains = c.BodyNotContains
+	validator.maxBodySize = c.MaxBodySize
+	return validator, nil
+}
+
+// parseStatusCodeRange parses an exact status code ("200"), a class ("2xx") or a range ("200-299").
+func parseStatusCodeRange(code string) (statusCodeRange, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if len(code) == 3 && strings.HasSuffix(code, "xx") {
+		class, err := strconv.Atoi(code[:1])
+		if err == nil {
+			return statusCodeRange{from: class * 100, to: class*100 + 99}, nil
+		}
+	}
+	if from, to, found := strings.Cut(code, "-"); found {
+		fromCode, errFrom := strconv.Atoi(strings.TrimSpace(from))
+		toCode, errTo := strconv.Atoi(strings.TrimSpace(to))
+		if errFrom == nil && errTo == nil && fromCode <= toCode {
+			return statusCodeRange{from: fromCode, to: toCode}, nil
+		}
+	}
+	exact, err := strconv.Atoi(code)
+	if err != nil {
+		return statusCodeRange{}, fmt.Errorf("invalid status code: %s", code)
+	}
+	return statusCodeRange{from: exact, to: exact}, nil
+}
+
+// validate returns the name of the first failed assertion, or an empty string when the response is as expected.
+// bodySize is the full size of the body, which may be larger than the body kept in memory.
+func (validator *httpValidator) validate(response *http.Response, body []byte, bodySize int64) string {
+	statusOK := false
+	for _, r := range validator.statusCodes {
+		if response.StatusCode >= r.from && response.StatusCode <= r.to {
+			statusOK = true
+			break
+		}
+	}
+	if !statusOK {
+		return "status_codes"
+	}
+
+	for header, re := range validator.requiredHeaders {
+		values, ok := response.Header[http.CanonicalHeaderKey(header)]
+		if !ok {
+			return "required_headers"
+		}
+		if re != nil && !re.MatchString(strings.Join(values, ", ")) {
+			return "required_headers"
+		}
+	}
+	for _, header := range validator.forbiddenHeaders {
+		if _, ok := response.Header[http.CanonicalHeaderKey(header)]; ok {
+			return "forbidden_headers"
+		}
+	}
+
+	if validator.maxBodySize > 0 && bodySize > validator.maxBodySize {
+		return "max_body_size"
+	}
+
+	for _, substring := range validator.bodyContains {
+		if !strings.Contains(string(body), substring) {
+			return "body_contains"
+		}
+	}
+	for _, substring := range validator.bodyNotContains {
+		if strings.Contains(string(body), substring) {
+			return "body_not_contains"
+		}
+	}
+	for _, re := range validator.bodyRegex {
+		if !re.Match(body) {
+			return "body_regex"
+		}
+	}
+	for _, re := range validator.bodyNotRegex {
+		if re.Match(body) {
+			return "body_not_regex"
+		}
+	}
+
+	if len(validator.jsonPath) > 0 {
+		var document interface{}
+		if err := json.Unmarshal(body, &document); err != nil {
+			return "json_path"
+		}
+		for _, check := range validator.jsonPath {
+			value, err := check.path.lookup(document)
+			if err != nil || !reflect.DeepEqual(value, check.value) {
+				return "json_path"
+			}
+		}
+	}
+	return ""
+}
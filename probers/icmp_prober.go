@@ -0,0 +1,237 @@
+package probers
+
+import (
+	"errors"
+	"fmt"
+	"inspector/metrics"
+	"inspector/mylogger"
+	"math"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/*
+ * Implementation of the icmp prober. It sends a number of echo requests to a host and measures the round trip times.
+ * Unprivileged datagram icmp sockets are used when the system allows them (see net.ipv4.ping_group_range), otherwise
+ * the prober falls back to raw sockets, which require elevated privileges.
+ * ICMP prober exports these 5 metrics: rtt_min, rtt_avg, rtt_max, jitter and packet_loss (in percent). The rtt metrics
+ * and jitter are only exported when at least one reply was received.
+ */
+
+var ICMP_DEFAULT_COUNT = 5
+var ICMP_DEFAULT_PACKET_INTERVAL = time.Second
+
+// lastICMPEchoID gives every prober its own echo id, starting from the pid to differ from the other processes too.
+// Raw sockets receive all the echo replies of the host, the id tells the replies of the concurrent probers apart.
+var lastICMPEchoID = uint32(os.Getpid())
+
+type ICMPProber struct {
+	TargetID       string
+	ProberID       string
+	Address        string
+	Count          int
+	PacketInterval string
+	Timeout        string
+	timeout        time.Duration
+	packetInterval time.Duration
+	conn           *icmp.PacketConn
+	dst            net.Addr
+	privileged     bool
+	ipv6           bool
+	id             int
+}
+
+func (icmpProber *ICMPProber) Initialize(targetID, proberID string) error {
+	icmpProber.TargetID = targetID
+	icmpProber.ProberID = proberID
+
+	var err error
+	icmpProber.timeout, err = time.ParseDuration(icmpProber.Timeout)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Invalid timeout duration: %s", err)
+		return err
+	}
+	icmpProber.packetInterval = ICMP_DEFAULT_PACKET_INTERVAL
+	if icmpProber.PacketInterval != "" {
+		icmpProber.packetInterval, err = time.ParseDuration(icmpProber.PacketInterval)
+		if err != nil {
+			return fmt.Errorf("invalid packet interval: %s, error: %w", icmpProber.PacketInterval, err)
+		}
+	}
+	if icmpProber.Count <= 0 {
+		icmpProber.Count = ICMP_DEFAULT_COUNT
+	}
+	icmpProber.id = int(atomic.AddUint32(&lastICMPEchoID, 1) & 0xffff)
+	return nil
+}
+
+// Connect resolves the host and opens the icmp socket. An unprivileged datagram socket is tried first.
+func (icmpProber *ICMPProber) Connect(c chan metrics.SingleMetric) error {
+	ipAddr, err := net.ResolveIPAddr("ip", icmpProber.Address)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Failed resolving address %s. Error: %s", icmpProber.Address, err)
+		return err
+	}
+	icmpProber.ipv6 = ipAddr.IP.To4() == nil
+
+	datagramNetwork, rawNetwork, listenAddr := "udp4", "ip4:icmp", "0.0.0.0"
+	if icmpProber.ipv6 {
+		datagramNetwork, rawNetwork, listenAddr = "udp6", "ip6:ipv6-icmp", "::"
+	}
+
+	icmpProber.conn, err = icmp.ListenPacket(datagramNetwork, listenAddr)
+	if err == nil {
+		icmpProber.dst = &net.UDPAddr{IP: ipAddr.IP, Zone: ipAddr.Zone}
+		return nil
+	}
+	mylogger.MainLogger.Infof("Unprivileged icmp socket not available, falling back to raw socket. Error: %s", err)
+
+	icmpProber.conn, err = icmp.ListenPacket(rawNetwork, listenAddr)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Failed opening icmp socket for address %s. Error: %s", icmpProber.Address, err)
+		return err
+	}
+	icmpProber.privileged = true
+	icmpProber.dst = ipAddr
+	return nil
+}
+
+func (icmpProber *ICMPProber) RunOnce(c chan metrics.SingleMetric) error {
+	var rtts []time.Duration
+	for seq := 0; seq < icmpProber.Count; seq++ {
+		start := time.Now()
+		rtt, err := icmpProber.ping(seq)
+		if err == nil {
+			rtts = append(rtts, rtt)
+		} else if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+		if seq < icmpProber.Count-1 {
+			time.Sleep(icmpProber.packetInterval - time.Since(start))
+		}
+	}
+
+	loss := 100 * float64(icmpProber.Count-len(rtts)) / float64(icmpProber.Count)
+	c <- metrics.CreateSingleMetric("packet_loss", loss, nil, icmpProber.tags())
+	if len(rtts) == 0 {
+		return nil
+	}
+
+	minRTT, maxRTT, sum := time.Duration(math.MaxInt64), time.Duration(0), time.Duration(0)
+	var jitter time.Duration
+	for i, rtt := range rtts {
+		minRTT = min(minRTT, rtt)
+		maxRTT = max(maxRTT, rtt)
+		sum += rtt
+		// Jitter is the mean difference between consecutive round trip times.
+		if i > 0 {
+			jitter += (rtt - rtts[i-1]).Abs()
+		}
+	}
+	if len(rtts) > 1 {
+		jitter /= time.Duration(len(rtts) - 1)
+	}
+
+	c <- metrics.CreateSingleMetric("rtt_min", metrics.Milliseconds(minRTT), nil, icmpProber.tags())
+	c <- metrics.CreateSingleMetric("rtt_avg", metrics.Milliseconds(sum/time.Duration(len(rtts))), nil, icmpProber.tags())
+	c <- metrics.CreateSingleMetric("rtt_max", metrics.Milliseconds(maxRTT), nil, icmpProber.tags())
+	c <- metrics.CreateSingleMetric("jitter", metrics.Milliseconds(jitter), nil, icmpProber.tags())
+	return nil
+}
+
+// ping sends a single echo request and waits for the matching reply until the timeout.
+func (icmpProber *ICMPProber) ping(seq int) (time.Duration, error) {
+	var requestType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	protocol := 1
+	if icmpProber.ipv6 {
+		requestType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		protocol = 58
+	}
+
+	request := icmp.Message{
+		Type: requestType,
+		Body: &icmp.Echo{
+			ID:   icmpProber.id,
+			Seq:  seq,
+			Data: []byte("inspector"),
+		},
+	}
+	data, err := request.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if _, err := icmpProber.conn.WriteTo(data, icmpProber.dst); err != nil {
+		return 0, err
+	}
+	if err := icmpProber.conn.SetReadDeadline(start.Add(icmpProber.timeout)); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := icmpProber.conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		if !icmpProber.isDestination(peer) {
+			continue
+		}
+		reply, err := icmp.ParseMessage(protocol, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		// The kernel rewrites the echo id of unprivileged sockets, so it can only be checked on raw sockets.
+		if !ok || echo.Seq != seq || (icmpProber.privileged && echo.ID != icmpProber.id) {
+			continue
+		}
+		return time.Since(start), nil
+	}
+}
+
+// isDestination tells whether the packet was received from the probed host.
+func (icmpProber *ICMPProber) isDestination(peer net.Addr) bool {
+	peerIP := addrIP(peer)
+	return peerIP != nil && peerIP.Equal(addrIP(icmpProber.dst))
+}
+
+// addrIP returns the ip of the addresses of the icmp sockets, raw sockets use ip addresses and datagram ones udp.
+func addrIP(addr net.Addr) net.IP {
+	switch typed := addr.(type) {
+	case *net.IPAddr:
+		return typed.IP
+	case *net.UDPAddr:
+		return typed.IP
+	}
+	return nil
+}
+
+func (icmpProber *ICMPProber) TearDown() error {
+	if icmpProber.conn == nil {
+		return nil
+	}
+	return icmpProber.conn.Close()
+}
+
+func (icmpProber *ICMPProber) tags() map[string]string {
+	return map[string]string{
+		"target_id": icmpProber.getTargetID(),
+		"prober_id": icmpProber.getProberID(),
+	}
+}
+
+func (icmpProber *ICMPProber) getTargetID() string {
+	return icmpProber.TargetID
+}
+
+func (icmpProber *ICMPProber) getProberID() string {
+	return icmpProber.ProberID
+}
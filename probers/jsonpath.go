@@ -0,0 +1,99 @@
+package probers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+ * A minimal JSONPath implementation, enough to address a single value in a decoded json document.
+ * Supported syntax: $.field, $.list[0], $["field with spaces"] and any combination of them. Wildcards, slices, filters
+ * and recursive descent are not supported.
+ * Paths are parsed once, when the prober is initialized, and looked up against every response.
+ */
+
+// jsonPathSelector selects either a field of an object or an element of a list.
+type jsonPathSelector struct {
+	field   string
+	index   int
+	isIndex bool
+}
+
+// jsonPath is a parsed json path.
+type jsonPath struct {
+	path      string
+	selectors []jsonPathSelector
+}
+
+// parseJSONPath parses a path in the $.field.list[0].field form.
+func parseJSONPath(path string) (jsonPath, error) {
+	parsed := jsonPath{path: path}
+	rest := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			if name == "" {
+				return jsonPath{}, fmt.Errorf("empty field name in json path: %s", path)
+			}
+			rest = rest[end:]
+			parsed.selectors = append(parsed.selectors, jsonPathSelector{field: name})
+		case '[':
+			end := strings.Index(rest, "]")
+			if end == -1 {
+				return jsonPath{}, fmt.Errorf("unterminated bracket in json path: %s", path)
+			}
+			selector := rest[1:end]
+			rest = rest[end+1:]
+			if len(selector) >= 2 && (selector[0] == '"' || selector[0] == '\'') && selector[len(selector)-1] == selector[0] {
+				parsed.selectors = append(parsed.selectors, jsonPathSelector{field: selector[1 : len(selector)-1]})
+				continue
+			}
+			index, err := strconv.Atoi(selector)
+			if err != nil {
+				return jsonPath{}, fmt.Errorf("invalid index %s in json path: %s", selector, path)
+			}
+			parsed.selectors = append(parsed.selectors, jsonPathSelector{index: index, isIndex: true})
+		default:
+			return jsonPath{}, fmt.Errorf("invalid json path: %s", path)
+		}
+	}
+	return parsed, nil
+}
+
+// lookup returns the value found at the path in a document decoded by encoding/json.
+func (path jsonPath) lookup(document interface{}) (interface{}, error) {
+	current := document
+	for _, selector := range path.selectors {
+		if !selector.isIndex {
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("json path: %s, field %s is not in an object", path.path, selector.field)
+			}
+			current, ok = object[selector.field]
+			if !ok {
+				return nil, fmt.Errorf("json path: %s, field %s not found", path.path, selector.field)
+			}
+			continue
+		}
+		list, ok := current.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("json path: %s, index %d is not in a list", path.path, selector.index)
+		}
+		index := selector.index
+		if index < 0 {
+			index += len(list)
+		}
+		if index < 0 || index >= len(list) {
+			return nil, fmt.Errorf("json path: %s, index %d out of range", path.path, selector.index)
+		}
+		current = list[index]
+	}
+	return current, nil
+}
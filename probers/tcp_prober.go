@@ -0,0 +1,144 @@
+package probers
+
+import (
+	"errors"
+	"fmt"
+	"inspector/metrics"
+	"inspector/mylogger"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"time"
+)
+
+/*
+ * Implementation of the tcp prober. It connects to a host:port, optionally sends a payload and matches the response
+ * (or the banner the server sends on connect) against a regular expression.
+ * TCP prober exports these 3 metrics: connect_time, up and banner_match. banner_match is only exported when an expected
+ * response is configured.
+ */
+
+// TCP_MAX_RESPONSE_SIZE caps how much of the response is read while looking for the expected response.
+var TCP_MAX_RESPONSE_SIZE = 64 * 1024
+
+type TCPProber struct {
+	TargetID         string
+	ProberID         string
+	Address          string
+	Payload          string
+	ExpectedResponse string
+	Timeout          string
+	timeout          time.Duration
+	expected         *regexp.Regexp
+	conn             net.Conn
+}
+
+func (tcpProber *TCPProber) Initialize(targetID, proberID string) error {
+	tcpProber.TargetID = targetID
+	tcpProber.ProberID = proberID
+
+	if _, _, err := net.SplitHostPort(tcpProber.Address); err != nil {
+		return fmt.Errorf("invalid address: %s, error: %w", tcpProber.Address, err)
+	}
+	var err error
+	tcpProber.timeout, err = time.ParseDuration(tcpProber.Timeout)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Invalid timeout duration: %s", err)
+		return err
+	}
+	if tcpProber.ExpectedResponse != "" {
+		tcpProber.expected, err = regexp.Compile(tcpProber.ExpectedResponse)
+		if err != nil {
+			return fmt.Errorf("invalid expected response: %s, error: %w", tcpProber.ExpectedResponse, err)
+		}
+	}
+	return nil
+}
+
+// Connect dials the remote endpoint. The up metric is exported here, since a failed dial is what makes a tcp
+// service down.
+func (tcpProber *TCPProber) Connect(c chan metrics.SingleMetric) error {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", tcpProber.Address, tcpProber.timeout)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Connection Failed for address %s. Error: %s", tcpProber.Address, err)
+		c <- metrics.CreateSingleMetric("up", 0, nil, tcpProber.tags())
+		return err
+	}
+	c <- metrics.CreateSingleMetric("connect_time", metrics.Milliseconds(time.Since(start)), nil, tcpProber.tags())
+	c <- metrics.CreateSingleMetric("up", 1, nil, tcpProber.tags())
+	tcpProber.conn = conn
+	return nil
+}
+
+func (tcpProber *TCPProber) RunOnce(c chan metrics.SingleMetric) error {
+	err := tcpProber.conn.SetDeadline(time.Now().Add(tcpProber.timeout))
+	if err != nil {
+		return err
+	}
+
+	if tcpProber.Payload != "" {
+		_, err = tcpProber.conn.Write([]byte(tcpProber.Payload))
+		if err != nil {
+			return err
+		}
+	}
+
+	if tcpProber.expected == nil {
+		return nil
+	}
+
+	matched, err := tcpProber.readUntilMatch()
+	var bannerMatch float64
+	if matched {
+		bannerMatch = 1
+	}
+	c <- metrics.CreateSingleMetric("banner_match", bannerMatch, nil, tcpProber.tags())
+	return err
+}
+
+// readUntilMatch reads from the connection until the expected response matches, the remote end closes the connection,
+// the deadline is hit or TCP_MAX_RESPONSE_SIZE is read. Hitting the deadline or EOF without a match is not an error.
+func (tcpProber *TCPProber) readUntilMatch() (bool, error) {
+	response := make([]byte, 0, 1024)
+	buf := make([]byte, 1024)
+	for len(response) < TCP_MAX_RESPONSE_SIZE {
+		n, err := tcpProber.conn.Read(buf)
+		response = append(response, buf[:n]...)
+		if tcpProber.expected.Match(response) {
+			return true, nil
+		}
+		if err != nil {
+			if err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+				mylogger.MainLogger.Infof("Response from %s did not match: %s", tcpProber.Address,
+					tcpProber.ExpectedResponse)
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func (tcpProber *TCPProber) TearDown() error {
+	if tcpProber.conn == nil {
+		return nil
+	}
+	return tcpProber.conn.Close()
+}
+
+func (tcpProber *TCPProber) tags() map[string]string {
+	return map[string]string{
+		"target_id": tcpProber.getTargetID(),
+		"prober_id": tcpProber.getProberID(),
+	}
+}
+
+func (tcpProber *TCPProber) getTargetID() string {
+	return tcpProber.TargetID
+}
+
+func (tcpProber *TCPProber) getProberID() string {
+	return tcpProber.ProberID
+}
@@ -0,0 +1,80 @@
+package probers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"inspector/config"
+	"os"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the tls client configuration of a prober. A nil config returns nil, which makes the standard
+// library use its defaults.
+func newTLSConfig(c *config.TLSSubConfig) (*tls.Config, error) {
+	if c == nil {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca file: %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	var ok bool
+	if c.MinVersion != "" {
+		tlsConfig.MinVersion, ok = tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported tls version: %s", c.MinVersion)
+		}
+	}
+	if c.MaxVersion != "" {
+		tlsConfig.MaxVersion, ok = tlsVersions[c.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported tls version: %s", c.MaxVersion)
+		}
+	}
+
+	if len(c.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range c.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unsupported cipher suite: %s", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+	return tlsConfig, nil
+}
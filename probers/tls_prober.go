@@ -0,0 +1,286 @@
+package probers
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"inspector/config"
+	"inspector/metrics"
+	"inspector/mylogger"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Implementation of the tls prober. It performs a raw tls handshake with a host:port, optionally after upgrading the
+ * connection with STARTTLS, and inspects the whole certificate chain presented by the server.
+ * The handshake always completes, even for invalid chains, so that broken certificates can still be inspected.
+ * TLS prober exports these metrics:
+ *   handshake_success, 1 when the handshake completed. A failed probe is tagged with the failed_stage: connect, starttls
+ *   or handshake, so broken endpoints are reported rather than silently missing.
+ *   connect_time and handshake_time, the latter tagged with the negotiated tls_version and cipher_suite.
+ *   hostname_valid and chain_valid, 1 when the verification passes.
+ *   certificate_expiry_seconds and key_size for every certificate in the chain, tagged with the position of the
+ *   certificate in the chain, its subject, key type and signature algorithm.
+ */
+
+type TLSProber struct {
+	TargetID   string
+	ProberID   string
+	Address    string
+	StartTLS   string
+	TLS        *config.TLSSubConfig
+	Timeout    string
+	timeout    time.Duration
+	serverName string
+	tlsConfig  *tls.Config
+	conn       net.Conn
+}
+
+func (tlsProber *TLSProber) Initialize(targetID, proberID string) error {
+	tlsProber.TargetID = targetID
+	tlsProber.ProberID = proberID
+
+	host, _, err := net.SplitHostPort(tlsProber.Address)
+	if err != nil {
+		return fmt.Errorf("invalid address: %s, error: %w", tlsProber.Address, err)
+	}
+	switch tlsProber.StartTLS {
+	case "", "smtp", "imap", "postgres":
+	default:
+		return fmt.Errorf("unsupported starttls protocol: %s", tlsProber.StartTLS)
+	}
+	tlsProber.timeout, err = time.ParseDuration(tlsProber.Timeout)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Invalid timeout duration: %s", err)
+		return err
+	}
+
+	tlsProber.tlsConfig, err = newTLSConfig(tlsProber.TLS)
+	if err != nil {
+		return err
+	}
+	if tlsProber.tlsConfig == nil {
+		tlsProber.tlsConfig = &tls.Config{}
+	}
+	tlsProber.serverName = tlsProber.tlsConfig.ServerName
+	if tlsProber.serverName == "" {
+		tlsProber.serverName = host
+	}
+	return nil
+}
+
+func (tlsProber *TLSProber) Connect(c chan metrics.SingleMetric) error {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", tlsProber.Address, tlsProber.timeout)
+	if err != nil {
+		mylogger.MainLogger.Errorf("Connection Failed for address %s. Error: %s", tlsProber.Address, err)
+		c <- metrics.CreateSingleMetric("handshake_success", 0, nil, tlsProber.tagsWith("failed_stage", "connect"))
+		return err
+	}
+	c <- metrics.CreateSingleMetric("connect_time", metrics.Milliseconds(time.Since(start)), nil, tlsProber.tags())
+	tlsProber.conn = conn
+	return nil
+}
+
+func (tlsProber *TLSProber) RunOnce(c chan metrics.SingleMetric) error {
+	err := tlsProber.conn.SetDeadline(time.Now().Add(tlsProber.timeout))
+	if err != nil {
+		return err
+	}
+	if tlsProber.StartTLS != "" {
+		err = tlsProber.startTLS()
+		if err != nil {
+			c <- metrics.CreateSingleMetric("handshake_success", 0, nil, tlsProber.tagsWith("failed_stage", "starttls"))
+			return fmt.Errorf("starttls %s failed: %w", tlsProber.StartTLS, err)
+		}
+	}
+
+	// Verification is done below by hand, so the chain can be inspected even when it is invalid.
+	handshakeConfig := tlsProber.tlsConfig.Clone()
+	handshakeConfig.ServerName = tlsProber.serverName
+	handshakeConfig.InsecureSkipVerify = true
+
+	start := time.Now()
+	tlsConn := tls.Client(tlsProber.conn, handshakeConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		c <- metrics.CreateSingleMetric("handshake_success", 0, nil, tlsProber.tagsWith("failed_stage", "handshake"))
+		return err
+	}
+	state := tlsConn.ConnectionState()
+	c <- metrics.CreateSingleMetric("handshake_success", 1, nil, tlsProber.tags())
+
+	handshakeTags := tlsProber.tags()
+	handshakeTags["tls_version"] = tls.VersionName(state.Version)
+	handshakeTags["cipher_suite"] = tls.CipherSuiteName(state.CipherSuite)
+	c <- metrics.CreateSingleMetric("handshake_time", metrics.Milliseconds(time.Since(start)), nil, handshakeTags)
+
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("no certificates presented by %s", tlsProber.Address)
+	}
+	leaf := state.PeerCertificates[0]
+
+	var hostnameValid float64
+	if leaf.VerifyHostname(tlsProber.serverName) == nil {
+		hostnameValid = 1
+	}
+	c <- metrics.CreateSingleMetric("hostname_valid", hostnameValid, nil, tlsProber.tags())
+
+	intermediates := x509.NewCertPool()
+	for _, certificate := range state.PeerCertificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+	var chainValid float64
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         tlsProber.tlsConfig.RootCAs,
+		Intermediates: intermediates,
+	})
+	if err == nil {
+		chainValid = 1
+	} else {
+		mylogger.MainLogger.Infof("Invalid certificate chain for %s: %s", tlsProber.Address, err)
+	}
+	c <- metrics.CreateSingleMetric("chain_valid", chainValid, nil, tlsProber.tags())
+
+	for i, certificate := range state.PeerCertificates {
+		keyType, keySize := publicKeyInfo(certificate)
+		certificateTags := tlsProber.tags()
+		certificateTags["cert_index"] = strconv.Itoa(i)
+		certificateTags["subject"] = certificate.Subject.CommonName
+		if certificateTags["subject"] == "" {
+			certificateTags["subject"] = certificate.Subject.String()
+		}
+		certificateTags["key_type"] = keyType
+		certificateTags["signature_algorithm"] = certificate.SignatureAlgorithm.String()
+		c <- metrics.CreateSingleMetric("certificate_expiry_seconds",
+			float64(int64(time.Until(certificate.NotAfter).Seconds())), nil, certificateTags)
+		c <- metrics.CreateSingleMetric("key_size", float64(keySize), nil, certificateTags)
+	}
+	return nil
+}
+
+// publicKeyInfo returns the type and the size in bits of the certificate's public key.
+func publicKeyInfo(certificate *x509.Certificate) (string, int) {
+	switch key := certificate.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA", key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	}
+	return certificate.PublicKeyAlgorithm.String(), 0
+}
+
+// startTLS asks the server to upgrade the plain connection to tls, using the configured protocol.
+func (tlsProber *TLSProber) startTLS() error {
+	reader := bufio.NewReader(tlsProber.conn)
+	switch tlsProber.StartTLS {
+	case "smtp":
+		if err := expectSMTPReply(reader, "220"); err != nil {
+			return err
+		}
+		if _, err := tlsProber.conn.Write([]byte("EHLO inspector\r\n")); err != nil {
+			return err
+		}
+		if err := expectSMTPReply(reader, "250"); err != nil {
+			return err
+		}
+		if _, err := tlsProber.conn.Write([]byte("STARTTLS\r\n")); err != nil {
+			return err
+		}
+		return expectSMTPReply(reader, "220")
+	case "imap":
+		greeting, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(greeting, "* OK") {
+			return fmt.Errorf("unexpected imap greeting: %s", strings.TrimSpace(greeting))
+		}
+		if _, err := tlsProber.conn.Write([]byte("a001 STARTTLS\r\n")); err != nil {
+			return err
+		}
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(line, "a001 ") {
+				if !strings.HasPrefix(line, "a001 OK") {
+					return fmt.Errorf("unexpected imap reply: %s", strings.TrimSpace(line))
+				}
+				return nil
+			}
+		}
+	case "postgres":
+		// SSLRequest message: length 8 followed by the 80877103 request code.
+		request := make([]byte, 8)
+		binary.BigEndian.PutUint32(request[0:4], 8)
+		binary.BigEndian.PutUint32(request[4:8], 80877103)
+		if _, err := tlsProber.conn.Write(request); err != nil {
+			return err
+		}
+		reply, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if reply != 'S' {
+			return fmt.Errorf("postgres server refused ssl")
+		}
+	}
+	return nil
+}
+
+// expectSMTPReply reads a (possibly multiline) smtp reply and checks its code.
+func expectSMTPReply(reader *bufio.Reader, code string) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, code) {
+			return fmt.Errorf("unexpected smtp reply: %s", strings.TrimSpace(line))
+		}
+		// The last line of a reply has a space after the code, the others have a dash.
+		if len(line) < 4 || line[3] != '-' {
+			return nil
+		}
+	}
+}
+
+func (tlsProber *TLSProber) TearDown() error {
+	if tlsProber.conn == nil {
+		return nil
+	}
+	return tlsProber.conn.Close()
+}
+
+func (tlsProber *TLSProber) tags() map[string]string {
+	return map[string]string{
+		"target_id": tlsProber.getTargetID(),
+		"prober_id": tlsProber.getProberID(),
+	}
+}
+
+func (tlsProber *TLSProber) tagsWith(key, value string) map[string]string {
+	tags := tlsProber.tags()
+	tags[key] = value
+	return tags
+}
+
+func (tlsProber *TLSProber) getTargetID() string {
+	return tlsProber.TargetID
+}
+
+func (tlsProber *TLSProber) getProberID() string {
+	return tlsProber.ProberID
+}
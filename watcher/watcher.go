@@ -5,11 +5,17 @@ package watcher
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 	"inspector/mylogger"
 	"github.com/fsnotify/fsnotify"
 )
 
+// WRITE_SETTLE_INTERVAL is how long a file must stay unmodified before its write event is sent. Editors and tools
+// often truncate a file before writing it, the content is only complete once the writes settle.
+var WRITE_SETTLE_INTERVAL = 500 * time.Millisecond
+
 /* 
 * Waits for the specified file to appear within the given timeout duration.
 * The timeoutStr should be in a format recognized by time.ParseDuration (e.g., "10s", "1m").
@@ -61,12 +67,16 @@ func restoreFile(filename string, timeoutStr string, watcher *fsnotify.Watcher)
 }
 
 // handleEvent processes filesystem events and takes appropriate actions based on the event type.
-// It logs creation, removal, and renaming events, and sends write events to the provided channel.
-func handleEvent(event fsnotify.Event, filename string, watcher *fsnotify.Watcher, events chan<- string) error {
+// It logs creation, removal, and renaming events, and sends write events to the provided channel unless stop is closed.
+func handleEvent(event fsnotify.Event, filename string, watcher *fsnotify.Watcher, events chan<- string,
+	stop <-chan struct{}) error {
 	switch {
 	case event.Op&fsnotify.Write == fsnotify.Write:
 		// File content was modified; send this event to the channel.
-		events <- "Write: " + event.Name
+		select {
+		case events <- "Write: " + event.Name:
+		case <-stop:
+		}
 	case event.Op&fsnotify.Create == fsnotify.Create:
 		// Log file creation.
 		mylogger.MainLogger.Infof("Create: %s", event.Name)
@@ -86,8 +96,11 @@ func handleEvent(event fsnotify.Event, filename string, watcher *fsnotify.Watche
 * WatchFile continuously monitors the specified file for changes.
 * It sends only content-related events (write) to the provided channel.
 * Other events such as create, remove, and rename are logged to the terminal.
+* The directories of the include globs are watched as well, the files matching the globs being added, removed or
+* modified are sent to the channel. The nearest existing parent of a directory which does not exist yet is watched
+* instead, until the directory is created. Watching stops once stop is closed.
 */
-func WatchFile(filename string, events chan<- string) error {
+func WatchFile(filename string, includes []string, events chan<- string, stop <-chan struct{}) error {
 	// Initially check if the file exists without any timeout.
 	if err := waitUntilFind(filename, "0s"); err != nil {
 		return err
@@ -102,9 +115,16 @@ func WatchFile(filename string, events chan<- string) error {
 	if err := watcher.Add(filename); err != nil {
 		return err
 	}
+	watched := make(map[string]bool)
+	watchIncludeDirectories(watcher, includes, watched)
 
 	var lastEventTime time.Time
 	var lastOp fsnotify.Op
+	// Write events are held back until the writes settle, a nil channel never fires.
+	var pendingWrite fsnotify.Event
+	var writeSettled <-chan time.Time
+	var pendingInclude string
+	var includeSettled <-chan time.Time
 
 	for {
 		select {
@@ -113,12 +133,32 @@ func WatchFile(filename string, events chan<- string) error {
 			if event.Op&fsnotify.Chmod == fsnotify.Chmod {
 				continue
 			}
+			// Events of the include directories, fragments matching the globs were added, removed or modified.
+			if event.Name != filename {
+				// A directory was created, it may be, or lead to, an include directory which did not exist yet.
+				if info, err := os.Stat(event.Name); event.Op&fsnotify.Create == fsnotify.Create && err == nil && info.IsDir() {
+					if watchIncludeDirectories(watcher, includes, watched) {
+						pendingInclude = "Include directory " + event.Op.String() + ": " + event.Name
+						includeSettled = time.After(WRITE_SETTLE_INTERVAL)
+					}
+				}
+				if matchesAny(event.Name, includes) {
+					pendingInclude = "Include " + event.Op.String() + ": " + event.Name
+					includeSettled = time.After(WRITE_SETTLE_INTERVAL)
+				}
+				continue
+			}
+			if event.Op&fsnotify.Write == fsnotify.Write {
+				pendingWrite = event
+				writeSettled = time.After(WRITE_SETTLE_INTERVAL)
+				continue
+			}
 			// Prevent processing duplicate events within a short time frame.
 			if time.Since(lastEventTime) < time.Second && event.Op == lastOp {
 				continue
 			}
 
-			if err := handleEvent(event, filename, watcher, events); err != nil {
+			if err := handleEvent(event, filename, watcher, events, stop); err != nil {
 				return err
 			}
 
@@ -126,9 +166,101 @@ func WatchFile(filename string, events chan<- string) error {
 			lastEventTime = time.Now()
 			lastOp = event.Op
 
+		case <-writeSettled:
+			writeSettled = nil
+			if err := handleEvent(pendingWrite, filename, watcher, events, stop); err != nil {
+				return err
+			}
+
+		case <-includeSettled:
+			includeSettled = nil
+			// The receiver may be gone already, e.g. busy reloading the config when the watcher was stopped.
+			select {
+			case events <- pendingInclude:
+			case <-stop:
+				return nil
+			}
+
+		case <-stop:
+			return nil
+
 		case err := <-watcher.Errors:
 			mylogger.MainLogger.Errorf("Watcher error: %v", err)
 			return err
 		}
 	}
 }
+
+// watchIncludeDirectories adds the include directories which are not watched yet to the watcher. It tells whether
+// one of the added directories holds files matching the globs, e.g. when a directory of fragments was moved in place.
+func watchIncludeDirectories(watcher *fsnotify.Watcher, includes []string, watched map[string]bool) bool {
+	matched := false
+	for _, directory := range includeDirectories(includes) {
+		if watched[directory] {
+			continue
+		}
+		if err := watcher.Add(directory); err != nil {
+			mylogger.MainLogger.Errorf("Failed watching include directory: %s, error: %s", directory, err)
+			continue
+		}
+		watched[directory] = true
+		for _, pattern := range includes {
+			if matches, _ := filepath.Glob(filepath.Join(directory, filepath.Base(pattern))); len(matches) > 0 {
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+// includeDirectories returns the directories holding the files matching the globs. For the globs whose directory does
+// not exist yet, the nearest existing parent directory is returned, its events tell when the directory gets created.
+func includeDirectories(includes []string) []string {
+	seen := make(map[string]bool)
+	directories := make([]string, 0)
+	for _, pattern := range includes {
+		// The directory part of the glob may be a glob itself.
+		matches, err := filepath.Glob(filepath.Dir(pattern))
+		if err != nil {
+			mylogger.MainLogger.Errorf("Invalid include pattern: %s, error: %s", pattern, err)
+			continue
+		}
+		if len(matches) == 0 {
+			if parent := nearestExistingParent(filepath.Dir(pattern)); parent != "" {
+				matches = append(matches, parent)
+			}
+		}
+		for _, directory := range matches {
+			if !seen[directory] {
+				seen[directory] = true
+				directories = append(directories, directory)
+			}
+		}
+	}
+	return directories
+}
+
+// nearestExistingParent returns the closest existing ancestor of the directory, ignoring its components past the
+// first one holding glob characters. It returns an empty string when none exists.
+func nearestExistingParent(directory string) string {
+	for directory != filepath.Dir(directory) {
+		directory = filepath.Dir(directory)
+		if strings.ContainsAny(directory, "*?[") {
+			continue
+		}
+		if info, err := os.Stat(directory); err == nil && info.IsDir() {
+			return directory
+		}
+	}
+	return ""
+}
+
+// matchesAny tells whether the file matches one of the globs.
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}